@@ -0,0 +1,373 @@
+package go_mtr
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	AnnotationASN    = "asn"
+	AnnotationASName = "as_name"
+	AnnotationPrefix = "prefix"
+)
+
+const (
+	mrtTableDumpV2     = 13
+	mrtRIBIPv4Unicast  = 2
+	mrtRIBIPv6Unicast  = 4
+	mrtRIBIPv4AddPath  = 8
+	mrtRIBIPv6AddPath  = 10
+	mrtHeaderLen       = 12
+	mrtMaxRecordLen    = 1 << 24
+	bgpAttrASPath      = 2
+	bgpAttrExtendedLen = 0x10
+	bgpASPathSet       = 1
+)
+
+var errMRTTruncated = errors.New("truncated mrt record")
+
+// ASNDB maps addresses to the origin AS of the longest prefix covering them,
+// as announced in a RIB dump.
+type ASNDB struct {
+	v4    prefixNode
+	v6    prefixNode
+	names map[uint32]string
+}
+
+type prefixNode struct {
+	child  [2]*prefixNode
+	prefix *net.IPNet
+	asn    uint32
+}
+
+func NewASNDB() *ASNDB {
+	return &ASNDB{names: map[uint32]string{}}
+}
+
+// OpenASNDB loads a RouteViews/RIPE RIB dump in MRT TABLE_DUMP_V2 format or a
+// CAIDA pfx2as file, told apart by their content. Files ending in .gz or .bz2
+// are decompressed.
+func OpenASNDB(path string) (*ASNDB, error) {
+	db := NewASNDB()
+	err := readCompressed(path, func(r io.Reader) error {
+		br := bufio.NewReader(r)
+		head, err := br.Peek(mrtHeaderLen)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(head) == mrtHeaderLen && binary.BigEndian.Uint16(head[4:6]) == mrtTableDumpV2 {
+			return db.LoadMRT(br)
+		}
+		return db.LoadPfx2AS(br)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load asn db (%v) error (%v)", path, err)
+	}
+	return db, nil
+}
+
+// LoadNames loads AS names, one "AS13335 CLOUDFLARENET, US" like line per AS,
+// the AS prefix being optional.
+func (db *ASNDB) LoadNames(path string) error {
+	err := readCompressed(path, func(r io.Reader) error {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			asn, err := parseASN(fields[0])
+			if err != nil {
+				continue
+			}
+			db.names[asn] = strings.TrimSpace(fields[1])
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("load as names (%v) error (%v)", path, err)
+	}
+	return nil
+}
+
+func readCompressed(path string, read func(r io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case strings.HasSuffix(path, ".bz2"):
+		r = bzip2.NewReader(f)
+	}
+	return read(r)
+}
+
+// LoadPfx2AS loads "1.0.0.0	24	13335" lines, the first AS of multi origin
+// prefixes and AS sets is kept.
+func (db *ASNDB) LoadPfx2AS(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		bits, err := strconv.Atoi(fields[1])
+		if ip == nil || err != nil {
+			continue
+		}
+		origins := strings.FieldsFunc(fields[2], func(r rune) bool { return r == '_' || r == ',' })
+		if len(origins) == 0 {
+			continue
+		}
+		asn, err := parseASN(origins[0])
+		if err != nil {
+			continue
+		}
+		db.Insert(ip, bits, asn)
+	}
+	return scanner.Err()
+}
+
+// LoadMRT loads the unicast RIBs of a TABLE_DUMP_V2 dump, the origin of a
+// prefix being the last AS of the path of its first entry.
+func (db *ASNDB) LoadMRT(r io.Reader) error {
+	head := make([]byte, mrtHeaderLen)
+	var body []byte
+	for {
+		_, err := io.ReadFull(r, head)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		typ := binary.BigEndian.Uint16(head[4:6])
+		subtype := binary.BigEndian.Uint16(head[6:8])
+		length := binary.BigEndian.Uint32(head[8:12])
+		if length > mrtMaxRecordLen {
+			return fmt.Errorf("mrt record of %v bytes", length)
+		}
+		if cap(body) < int(length) {
+			body = make([]byte, length)
+		}
+		body = body[:length]
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			return err
+		}
+		if typ != mrtTableDumpV2 {
+			continue
+		}
+		var v6, addPath bool
+		switch subtype {
+		case mrtRIBIPv4Unicast:
+		case mrtRIBIPv6Unicast:
+			v6 = true
+		case mrtRIBIPv4AddPath:
+			addPath = true
+		case mrtRIBIPv6AddPath:
+			v6, addPath = true, true
+		default:
+			continue
+		}
+		err = db.loadRIB(body, v6, addPath)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (db *ASNDB) loadRIB(b []byte, v6, addPath bool) error {
+	// sequence number, prefix length and prefix.
+	if len(b) < 5 {
+		return errMRTTruncated
+	}
+	bits := int(b[4])
+	n := (bits + 7) / 8
+	b = b[5:]
+	if len(b) < n+2 {
+		return errMRTTruncated
+	}
+	ip := make(net.IP, net.IPv4len)
+	if v6 {
+		ip = make(net.IP, net.IPv6len)
+	}
+	if n > len(ip) {
+		return fmt.Errorf("mrt prefix length %v", bits)
+	}
+	copy(ip, b[:n])
+	count := binary.BigEndian.Uint16(b[n : n+2])
+	b = b[n+2:]
+	for i := 0; i < int(count); i++ {
+		// peer index, originated time and the path id of add-path ribs.
+		skip := 6
+		if addPath {
+			skip += 4
+		}
+		if len(b) < skip+2 {
+			return errMRTTruncated
+		}
+		attrLen := int(binary.BigEndian.Uint16(b[skip : skip+2]))
+		b = b[skip+2:]
+		if len(b) < attrLen {
+			return errMRTTruncated
+		}
+		asn, ok := originAS(b[:attrLen])
+		b = b[attrLen:]
+		if ok {
+			db.Insert(ip, bits, asn)
+			return nil
+		}
+	}
+	return nil
+}
+
+// originAS finds the last AS of the AS_PATH of bgp attributes, which are
+// always encoded with 4 byte ASes in TABLE_DUMP_V2.
+func originAS(attrs []byte) (uint32, bool) {
+	for len(attrs) >= 3 {
+		flags, typ := attrs[0], attrs[1]
+		hdr, length := 3, int(attrs[2])
+		if flags&bgpAttrExtendedLen != 0 {
+			if len(attrs) < 4 {
+				return 0, false
+			}
+			hdr, length = 4, int(binary.BigEndian.Uint16(attrs[2:4]))
+		}
+		if len(attrs) < hdr+length {
+			return 0, false
+		}
+		value := attrs[hdr : hdr+length]
+		attrs = attrs[hdr+length:]
+		if typ != bgpAttrASPath {
+			continue
+		}
+		var origin uint32
+		var found bool
+		for len(value) >= 2 {
+			segType, segLen := value[0], int(value[1])
+			if len(value) < 2+segLen*4 || segLen == 0 {
+				break
+			}
+			idx := segLen - 1
+			if segType == bgpASPathSet {
+				idx = 0
+			}
+			origin = binary.BigEndian.Uint32(value[2+idx*4:])
+			found = true
+			value = value[2+segLen*4:]
+		}
+		return origin, found
+	}
+	return 0, false
+}
+
+func parseASN(s string) (uint32, error) {
+	s = strings.TrimPrefix(strings.ToUpper(s), "AS")
+	asn, err := strconv.ParseUint(s, 10, 32)
+	return uint32(asn), err
+}
+
+// Insert announces the prefix ip/bits from asn.
+func (db *ASNDB) Insert(ip net.IP, bits int, asn uint32) {
+	node, size := &db.v6, net.IPv6len*8
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, node, size = ip4, &db.v4, net.IPv4len*8
+	} else {
+		ip = ip.To16()
+	}
+	if ip == nil || bits < 0 || bits > size {
+		return
+	}
+	for i := 0; i < bits; i++ {
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		if node.child[bit] == nil {
+			node.child[bit] = &prefixNode{}
+		}
+		node = node.child[bit]
+	}
+	node.prefix = &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+	node.asn = asn
+}
+
+// Lookup returns the longest prefix covering ip and its origin AS.
+func (db *ASNDB) Lookup(ip net.IP) (*net.IPNet, uint32, bool) {
+	node, size := &db.v6, net.IPv6len*8
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, node, size = ip4, &db.v4, net.IPv4len*8
+	} else {
+		ip = ip.To16()
+	}
+	if ip == nil {
+		return nil, 0, false
+	}
+	var match *prefixNode
+	for i := 0; node != nil; i++ {
+		if node.prefix != nil {
+			match = node
+		}
+		if i == size {
+			break
+		}
+		node = node.child[ip[i/8]>>(7-uint(i%8))&1]
+	}
+	if match == nil {
+		return nil, 0, false
+	}
+	return match.prefix, match.asn, true
+}
+
+// Enrich annotates ip with AnnotationASN, AnnotationPrefix and, when names
+// were loaded, AnnotationASName.
+func (db *ASNDB) Enrich(ctx context.Context, ip string) (map[string]string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid addr (%v)", ip)
+	}
+	prefix, asn, ok := db.Lookup(addr)
+	if !ok {
+		return nil, nil
+	}
+	ann := map[string]string{
+		AnnotationASN:    strconv.FormatUint(uint64(asn), 10),
+		AnnotationPrefix: prefix.String(),
+	}
+	if name, ok := db.names[asn]; ok {
+		ann[AnnotationASName] = name
+	}
+	return ann, nil
+}
+
+// ASPath lists the ASes the hops of t cross in ttl order, as annotated by an
+// ASNDB, hops without an AS are skipped.
+func (t TraceResult) ASPath() []string {
+	var path []string
+	for _, r := range t.Aggregate().Res {
+		asn, ok := r.Annotations[AnnotationASN]
+		if !ok || (len(path) > 0 && path[len(path)-1] == asn) {
+			continue
+		}
+		path = append(path, asn)
+	}
+	return path
+}
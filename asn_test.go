@@ -0,0 +1,127 @@
+package go_mtr
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mrtRecord(subtype uint16, body []byte) []byte {
+	rec := make([]byte, mrtHeaderLen, mrtHeaderLen+len(body))
+	binary.BigEndian.PutUint16(rec[4:6], mrtTableDumpV2)
+	binary.BigEndian.PutUint16(rec[6:8], subtype)
+	binary.BigEndian.PutUint32(rec[8:12], uint32(len(body)))
+	return append(rec, body...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(appendUint16(b, uint16(v>>16)), byte(v>>8), byte(v))
+}
+
+// mrtRIB is a rib record of prefix with one entry per path, paths being 4
+// byte AS_SEQUENCEs.
+func mrtRIB(subtype uint16, prefix string, paths ...[]uint32) []byte {
+	_, ipNet, _ := net.ParseCIDR(prefix)
+	bits, _ := ipNet.Mask.Size()
+	body := []byte{0, 0, 0, 1, byte(bits)}
+	body = append(body, ipNet.IP[:(bits+7)/8]...)
+	body = appendUint16(body, uint16(len(paths)))
+	for _, path := range paths {
+		body = append(body, 0, 0, 0, 0, 0, 0)
+		// ORIGIN then AS_PATH with an extended length.
+		attrs := []byte{0x40, 1, 1, 0, 0x50, bgpAttrASPath}
+		seg := []byte{2, byte(len(path))}
+		for _, asn := range path {
+			seg = appendUint32(seg, asn)
+		}
+		attrs = appendUint16(attrs, uint16(len(seg)))
+		attrs = append(attrs, seg...)
+		body = appendUint16(body, uint16(len(attrs)))
+		body = append(body, attrs...)
+	}
+	return mrtRecord(subtype, body)
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if filepath.Ext(name) == ".gz" {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		_, err = gz.Write(data)
+	} else {
+		_, err = f.Write(data)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestASNDBMRT(t *testing.T) {
+	var dump []byte
+	dump = append(dump, mrtRecord(1, []byte{1, 2, 3, 4, 0, 0, 0, 0})...)
+	dump = append(dump, mrtRIB(mrtRIBIPv4Unicast, "10.0.0.0/8", []uint32{3356, 64500})...)
+	dump = append(dump, mrtRIB(mrtRIBIPv4Unicast, "10.0.2.0/24", []uint32{174, 4200000000}, []uint32{3356, 64502})...)
+	dump = append(dump, mrtRIB(mrtRIBIPv6Unicast, "2001:db8::/32", []uint32{6939, 64501})...)
+	db, err := OpenASNDB(writeFile(t, "rib.gz", dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{
+		"10.0.1.1":    "64500 10.0.0.0/8",
+		"10.0.2.1":    "4200000000 10.0.2.0/24",
+		"2001:db8::1": "64501 2001:db8::/32",
+		"192.0.2.1":   "",
+	} {
+		ann, err := db.Enrich(context.Background(), ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ann[AnnotationASN] + " " + ann[AnnotationPrefix]; got != want && !(want == "" && ann == nil) {
+			t.Fatalf("%v annotated %v want %v", ip, ann, want)
+		}
+	}
+}
+
+func TestASNDBPfx2AS(t *testing.T) {
+	db, err := OpenASNDB(writeFile(t, "pfx2as", []byte("10.0.0.0\t8\t64500\n10.0.2.0\t23\t64502_64503\n10.0.3.0\t24\t64503,64504\n10.0.4.0\t24\t_\n10.0.5.0\t24\t,\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.LoadNames(writeFile(t, "asn.txt", []byte("AS64500 EXAMPLE-A, US\n64502 EXAMPLE-B, DE\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lines without an origin are skipped.
+	if prefix, asn, ok := db.Lookup(net.ParseIP("10.0.4.1")); !ok || asn != 64500 || prefix.String() != "10.0.0.0/8" {
+		t.Fatalf("line without origin loaded %v %v", prefix, asn)
+	}
+	net := &fakeNet{hops: 4}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 50, Enrichers: []Enricher{db}}, net)
+	res := tr.BatchTrace([]Trace{fakeTrace(t)}, 1)[0]
+	agg := res.Aggregate()
+	if ann := agg.Res[1].Annotations; ann[AnnotationASN] != "64502" || ann[AnnotationASName] != "EXAMPLE-B, DE" || ann[AnnotationPrefix] != "10.0.2.0/23" {
+		t.Fatalf("unexpected annotations\n%v", agg.Marshal())
+	}
+	if ann := agg.Res[2].Annotations; ann[AnnotationASN] != "64503" || ann[AnnotationASName] != "" {
+		t.Fatalf("longest prefix not matched\n%v", agg.Marshal())
+	}
+	if path := res.ASPath(); !reflect.DeepEqual(path, []string{"64500", "64502", "64503", "64500"}) {
+		t.Fatalf("unexpected as path %v\n%v", path, agg.Marshal())
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
 	"strings"
 	"time"
 
@@ -20,21 +23,49 @@ func init() {
 		Run:   run,
 	}
 	cobra.OnInitialize()
-	root.PersistentFlags().StringP("source", "s", go_mtr.GetOutbondIP(), "source ip address, config which nic to send probe packet, 源IP")
-	root.PersistentFlags().StringP("target", "t", "127.0.0.1", "target ip address, 目的IP")
+	root.PersistentFlags().StringP("source", "s", "", "source ip address, config which nic to send probe packet, picked from the routing table by default, 源IP")
+	root.PersistentFlags().StringP("target", "t", "127.0.0.1", "target ip address or host name, 目的IP或域名")
+	root.PersistentFlags().BoolP("ipv4", "4", false, "resolve the target to an ipv4 address")
+	root.PersistentFlags().BoolP("ipv6", "6", false, "resolve the target to an ipv6 address")
+	root.PersistentFlags().StringP("interface", "I", "", "interface or vrf to send probes out and receive replies through")
+	root.PersistentFlags().Uint32P("mark", "M", 0, "fwmark probes are sent with, so they follow its policy routes")
+	root.PersistentFlags().String("netns", "", "network namespace to trace from, a path like /var/run/netns/blue or a pid")
 	root.PersistentFlags().Uint16("source_port", 65533, "source port, 源端口")
 	root.PersistentFlags().Uint16("target_port", 65535, "target port, 目的端口")
 	root.PersistentFlags().IntP("count", "c", 1, "how many times retry on each hop, 每跳ttl重试次数")
 	root.PersistentFlags().Int("max_unreply", 8, "stop detect when max unreply hop exceeded, 最大连续无回复hop次数 判断不可达")
-	root.PersistentFlags().String("type", "icmp", "detect type, icmp/udp proto")
+	root.PersistentFlags().String("type", "icmp", "detect type, icmp/udp/tcp proto")
+	root.PersistentFlags().BoolP("no-dns", "n", false, "show hop addresses without looking their names up")
+	root.PersistentFlags().String("asn_db", "", "annotate hops with their AS from a mrt rib dump or pfx2as file")
+	root.PersistentFlags().String("asn_names", "", "AS names file, one \"AS13335 NAME\" line per AS")
+	root.PersistentFlags().String("geoip_db", "", "annotate hops with their location from a GeoLite2 mmdb file")
+	root.PersistentFlags().Duration("geoip_reload", time.Minute, "check the geoip db for changes this often, 0 never reloads it")
+	root.PersistentFlags().StringSlice("enrich_csv", nil, "annotate hops from csv files, an ip or prefix column then one column per annotation")
+	root.PersistentFlags().Bool("compare", false, "trace with icmp, udp and tcp interleaved and show which hops answer each")
 	root.PersistentFlags().Duration("timeout_per_pkt", time.Millisecond*200, "timeout per packet")
 	root.PersistentFlags().Int("start_ttl", 1, "start ttl")
 	root.PersistentFlags().Uint8("max_ttl", 30, "max ttl")
+	root.PersistentFlags().Int("ttl_window", 0, "probes kept in flight across the ttl range, 0 probes hop by hop")
+	root.PersistentFlags().Float64("rate", 0, "max probes per second, 0 is unlimited")
+	root.PersistentFlags().Int("burst", 1, "probes which may be sent at once above rate")
+	root.PersistentFlags().Duration("prefix_pacing", 0, "min gap between probes to the same destination prefix")
+	root.PersistentFlags().Duration("hop_pacing", 0, "min gap between probes to the same router")
+	root.PersistentFlags().Float64Slice("percentiles", nil, "latency percentiles reported per hop, like 50,95,99")
+	root.PersistentFlags().Bool("loss", false, "analyze which hop loss is forwarding loss and which rate limiting")
+	root.PersistentFlags().Duration("loss_pacing", 0, "probe hops suspected of rate limiting again with this gap between probes")
+	root.PersistentFlags().Bool("mtr", false, "keep probing every hop in cycles and show rolling statistics")
+	root.PersistentFlags().Int("cycles", 0, "cycles to run in mtr mode, 0 runs until interrupted")
+	root.PersistentFlags().Duration("interval", time.Second, "interval between cycles in mtr mode")
 }
 
 func run(cmd *cobra.Command, args []string) {
 	source, _ := root.PersistentFlags().GetString("source")
 	target, _ := root.PersistentFlags().GetString("target")
+	ipv4, _ := root.PersistentFlags().GetBool("ipv4")
+	ipv6, _ := root.PersistentFlags().GetBool("ipv6")
+	iface, _ := root.PersistentFlags().GetString("interface")
+	mark, _ := root.PersistentFlags().GetUint32("mark")
+	netns, _ := root.PersistentFlags().GetString("netns")
 	sPort, _ := root.PersistentFlags().GetUint16("source_port")
 	dPort, _ := root.PersistentFlags().GetUint16("target_port")
 	retry, _ := root.PersistentFlags().GetInt("count")
@@ -43,17 +74,69 @@ func run(cmd *cobra.Command, args []string) {
 	to, _ := root.PersistentFlags().GetDuration("timeout_per_pkt")
 	ttlStart, _ := root.PersistentFlags().GetInt("start_ttl")
 	ttlMax, _ := root.PersistentFlags().GetUint8("max_ttl")
+	ttlWindow, _ := root.PersistentFlags().GetInt("ttl_window")
+	rate, _ := root.PersistentFlags().GetFloat64("rate")
+	burst, _ := root.PersistentFlags().GetInt("burst")
+	prefixPacing, _ := root.PersistentFlags().GetDuration("prefix_pacing")
+	hopPacing, _ := root.PersistentFlags().GetDuration("hop_pacing")
+	percentiles, _ := root.PersistentFlags().GetFloat64Slice("percentiles")
+	noDNS, _ := root.PersistentFlags().GetBool("no-dns")
+	asnDB, _ := root.PersistentFlags().GetString("asn_db")
+	asnNames, _ := root.PersistentFlags().GetString("asn_names")
+	geoipDB, _ := root.PersistentFlags().GetString("geoip_db")
+	geoipReload, _ := root.PersistentFlags().GetDuration("geoip_reload")
+	enrichCSV, _ := root.PersistentFlags().GetStringSlice("enrich_csv")
+	compare, _ := root.PersistentFlags().GetBool("compare")
+	loss, _ := root.PersistentFlags().GetBool("loss")
+	lossPacing, _ := root.PersistentFlags().GetDuration("loss_pacing")
+	mtr, _ := root.PersistentFlags().GetBool("mtr")
+	cycles, _ := root.PersistentFlags().GetInt("cycles")
+	interval, _ := root.PersistentFlags().GetDuration("interval")
 	conf := go_mtr.Config{
-		MaxUnReply:  maxUnreply,
-		NextHopWait: to,
+		MaxUnReply:   maxUnreply,
+		NextHopWait:  to,
+		TTLWindow:    ttlWindow,
+		ProbeRate:    rate,
+		ProbeBurst:   burst,
+		PrefixPacing: prefixPacing,
+		HopPacing:    hopPacing,
+		Percentiles:  percentiles,
+		ReverseDNS:   !noDNS,
+		GeoIPDB:      geoipDB,
+		GeoIPReload:  geoipReload,
+	}
+	if asnDB != "" {
+		db, err := go_mtr.OpenASNDB(asnDB)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if asnNames != "" {
+			err = db.LoadNames(asnNames)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		conf.Enrichers = append(conf.Enrichers, db)
+	}
+	for _, path := range enrichCSV {
+		e, err := go_mtr.OpenCSVEnricher(path)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		conf.Enrichers = append(conf.Enrichers, e)
 	}
 	tp = strings.Trim(tp, " ")
 	if tp == "icmp" {
 		conf.ICMP = true
 	} else if tp == "udp" {
 		conf.UDP = true
+	} else if tp == "tcp" {
+		conf.TCP = true
 	} else {
-		cmd.PrintErrf("invalid detect type (%v) must be udp/icmp\n", tp)
+		cmd.PrintErrf("invalid detect type (%v) must be udp/icmp/tcp\n", tp)
 		return
 	}
 	tracer, err := go_mtr.NewTrace(conf)
@@ -63,25 +146,71 @@ func run(cmd *cobra.Command, args []string) {
 	}
 	go tracer.Listen()
 	defer tracer.Close()
+	family := ""
+	if ipv4 {
+		family = go_mtr.FamilyIPv4
+	} else if ipv6 {
+		family = go_mtr.FamilyIPv6
+	}
 	t, err := go_mtr.GetTrace(&go_mtr.Trace{
-		SrcAddr: source,
-		DstAddr: target,
-		SrcPort: sPort,
-		DstPort: dPort,
-		MaxTTL:  ttlMax,
-		Retry:   retry,
+		SrcAddr:     source,
+		DstAddr:     target,
+		Family:      family,
+		Interface:   iface,
+		Netns:       netns,
+		Mark:        mark,
+		SrcPort:     sPort,
+		DstPort:     dPort,
+		MaxTTL:      ttlMax,
+		Retry:       retry,
+		Percentiles: percentiles,
 	})
+	if t.DstName != "" {
+		target = fmt.Sprintf("%v (%v)", t.DstName, t.DstAddr)
+	}
+	source = t.SrcAddr
 	fmt.Println("source:", source, "source_port:", sPort, "target:", target, "tareget_port:", dPort, "count:", retry, "max_unreply:", maxUnreply, "type:", tp, "timeout:", to, "ttl_start:", ttlStart)
 	if err != nil {
 		fmt.Printf("trace param error (%v)", err)
 		return
 	}
-	res := tracer.BatchTrace([]go_mtr.Trace{*t}, uint8(ttlStart))
-	for _, r := range res {
-		fmt.Println("================not aggregate==============")
-		fmt.Println(r.Marshal())
-		fmt.Println("==================aggregate================")
-		fmt.Println(r.MarshalAggregate())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if compare {
+		fmt.Println(tracer.CompareProtocols(ctx, *t, uint8(ttlStart)).Marshal())
+		return
+	}
+	if mtr {
+		session := go_mtr.NewSession(tracer, *t, go_mtr.SessionConfig{
+			Interval: interval,
+			Cycles:   cycles,
+			StartTTL: uint8(ttlStart),
+			OnCycle: func(s *go_mtr.Session) {
+				fmt.Printf("==================cycle %d================\n", s.Cycles())
+				fmt.Println(s.Marshal())
+			},
+		})
+		session.Run(ctx)
+		return
+	}
+	for ev := range tracer.BatchTraceStream(ctx, []go_mtr.Trace{*t}, uint8(ttlStart)) {
+		switch ev.Type {
+		case go_mtr.EventHopDone:
+			fmt.Println(go_mtr.TraceResult{Trace: *t}.MarshalHop(ev.Hop))
+		case go_mtr.EventTraceDone:
+			fmt.Println("================not aggregate==============")
+			fmt.Println(ev.Result.Marshal())
+			fmt.Println("==================aggregate================")
+			fmt.Println(ev.Result.MarshalAggregate())
+			if loss || lossPacing > 0 {
+				fmt.Println("====================loss===================")
+				la := ev.Result.AnalyzeLoss()
+				if lossPacing > 0 {
+					la = tracer.ConfirmLoss(ctx, *ev.Result, lossPacing)
+				}
+				fmt.Println(la.Marshal())
+			}
+		}
 	}
 }
 
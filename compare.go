@@ -0,0 +1,163 @@
+package go_mtr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ProtocolHop holds what every protocol found at one ttl.
+type ProtocolHop struct {
+	TTL  uint8
+	Hops map[string]TraceRes
+}
+
+// ProtocolComparison is the merged view of a target traced with several
+// protocols, to tell where a path filters one protocol but not the others.
+type ProtocolComparison struct {
+	Trace
+	Protocols []string
+	Results   map[string]TraceResult
+	Hops      []ProtocolHop
+	// StopTTL is the last ttl each protocol got a reply on, where its path
+	// stops unless the target was reached.
+	StopTTL   map[string]uint8
+	Cancelled bool
+}
+
+// CompareProtocols traces the same target with each of protocols, icmp, udp
+// and tcp when none is given. Probes of the protocols are interleaved ttl by
+// ttl, so they see the path at the same time, and each protocol stops on its
+// own once it reaches the target or MaxUnReply hops stay silent.
+func (t *tracer) CompareProtocols(ctx context.Context, trace Trace, startTTL uint8, protocols ...string) ProtocolComparison {
+	if len(protocols) == 0 {
+		protocols = []string{ProtoICMP, ProtoUDP, ProtoTCP}
+	}
+	cmp := ProtocolComparison{
+		Trace:     trace,
+		Protocols: protocols,
+		Results:   map[string]TraceResult{},
+		StopTTL:   map[string]uint8{},
+	}
+	if trace.Timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, trace.Timeout)
+		defer cancel()
+	}
+	t.pool.enqueue(1)
+	err := t.pool.acquire(ctx, trace.Priority)
+	if err != nil {
+		t.pool.drop(1)
+		cmp.Cancelled = true
+		return cmp
+	}
+	defer t.pool.release()
+	var runs []*traceRun
+	for _, proto := range protocols {
+		b := trace
+		b.Protocol = proto
+		tc, err := t.newTraceResult(b)
+		if err == nil {
+			err = t.listenFor(tc.Trace)
+		}
+		if err != nil {
+			tc.Err = err
+			cmp.Results[proto] = *tc
+			continue
+		}
+		if t.assignId(tc) != nil {
+			t.unlistenFor(tc.Trace)
+			cmp.Results[proto] = *tc
+			continue
+		}
+		runs = append(runs, t.newRun(ctx, tc, func(TraceEvent) {}))
+	}
+	done := make([]bool, len(runs))
+	for ttl := int(startTTL); ttl <= int(trace.MaxTTL); ttl++ {
+		active := false
+		for idx, run := range runs {
+			if done[idx] {
+				continue
+			}
+			replied := t.probeTTL(run, uint8(ttl))
+			if run.tc.Cancelled || run.hopFinished(uint8(ttl), replied) {
+				done[idx] = true
+				continue
+			}
+			active = true
+		}
+		if !active {
+			break
+		}
+	}
+	for _, run := range runs {
+		t.closeRun(run)
+		t.describe(run.tc)
+		cmp.Results[run.tc.Protocol] = *run.tc
+		cmp.Cancelled = cmp.Cancelled || run.tc.Cancelled
+	}
+	cmp.merge()
+	return cmp
+}
+
+func (c *ProtocolComparison) merge() {
+	byTTL := map[uint8]*ProtocolHop{}
+	var maxTTL uint8
+	for proto, res := range c.Results {
+		for _, r := range res.Aggregate().Res {
+			h, ok := byTTL[r.TTL]
+			if !ok {
+				h = &ProtocolHop{TTL: r.TTL, Hops: map[string]TraceRes{}}
+				byTTL[r.TTL] = h
+			}
+			h.Hops[proto] = r
+			if r.PacketLoss < 1 {
+				c.StopTTL[proto] = r.TTL
+			}
+			if r.TTL > maxTTL {
+				maxTTL = r.TTL
+			}
+		}
+	}
+	for ttl := 0; ttl <= int(maxTTL); ttl++ {
+		if h, ok := byTTL[uint8(ttl)]; ok {
+			c.Hops = append(c.Hops, *h)
+		}
+	}
+}
+
+// Marshal prints the hops of every protocol side by side, '*' marks a ttl
+// a protocol got no reply on and a blank one it did not probe.
+func (c ProtocolComparison) Marshal() string {
+	head := fmt.Sprintf("%-5s", "ttl")
+	for _, proto := range c.Protocols {
+		head += fmt.Sprintf("%-30s", proto)
+	}
+	line := []string{head}
+	for _, h := range c.Hops {
+		l := fmt.Sprintf("%-5d", h.TTL)
+		for _, proto := range c.Protocols {
+			r, ok := h.Hops[proto]
+			switch {
+			case !ok:
+				l += fmt.Sprintf("%-30s", "")
+			case r.PacketLoss >= 1:
+				l += fmt.Sprintf("%-30s", "*")
+			default:
+				l += fmt.Sprintf("%-16s%-14v", r.SrcTTL, r.Latency.Round(time.Microsecond))
+			}
+		}
+		line = append(line, l)
+	}
+	stop := fmt.Sprintf("%-5s", "stop")
+	for _, proto := range c.Protocols {
+		s := fmt.Sprintf("%v", c.StopTTL[proto])
+		if c.Results[proto].Done {
+			s += " reached"
+		}
+		stop += fmt.Sprintf("%-30s", s)
+	}
+	line = append(line, stop)
+	return strings.Join(line, "\n")
+}
@@ -63,6 +63,17 @@ type headerIpv4UDP struct {
 	checkSum uint16
 }
 
+type headerIpv4TCP struct {
+	srcPort  uint16
+	dstPort  uint16
+	seq      uint32
+	ack      uint32
+	offFlags uint16
+	window   uint16
+	checkSum uint16
+	urgent   uint16
+}
+
 type headerPseudo struct {
 	ipSrc   [4]byte
 	ipDst   [4]byte
@@ -86,16 +97,31 @@ func (h *headerIpv4) checksum() {
 	h.checkSum = checksum(b.Bytes())
 }
 
-func (h *headerICMPEcho) checksum() {
+func (h *headerICMPEcho) checksum(payload []byte) {
 	h.checkSum = 0
 	var b bytes.Buffer
 	binary.Write(&b, binary.BigEndian, h)
-	//binary.Write(&b, binary.BigEndian, payload)
+	b.Write(payload)
 	h.checkSum = checksum(b.Bytes())
 }
 
 func (h *headerIpv4UDP) checksum(ip *headerIpv4, payload []byte) {
 	h.checkSum = 0
+	h.checkSum = checksum(h.pseudoBytes(ip, payload))
+}
+
+// seqPayload fills the first two bytes of payload so that the udp checksum
+// equals seq. Routers quote the checksum back in time exceeded messages, which
+// identifies the probe without changing the ports flow hashing is based on.
+func (h *headerIpv4UDP) seqPayload(ip *headerIpv4, payload []byte, seq uint16) {
+	h.checkSum = 0
+	payload[0], payload[1] = 0, 0
+	sum := sum16(h.pseudoBytes(ip, payload))
+	fill := add16(^seq, ^sum)
+	payload[0], payload[1] = byte(fill>>8), byte(fill)
+}
+
+func (h *headerIpv4UDP) pseudoBytes(ip *headerIpv4, payload []byte) []byte {
 	pse := headerPseudo{
 		ipSrc:   ip.src,
 		ipDst:   ip.dst,
@@ -107,6 +133,21 @@ func (h *headerIpv4UDP) checksum(ip *headerIpv4, payload []byte) {
 	binary.Write(&b, binary.BigEndian, &pse)
 	binary.Write(&b, binary.BigEndian, h)
 	binary.Write(&b, binary.BigEndian, &payload)
+	return b.Bytes()
+}
+
+func (h *headerIpv4TCP) checksum(ip *headerIpv4) {
+	h.checkSum = 0
+	pse := headerPseudo{
+		ipSrc:   ip.src,
+		ipDst:   ip.dst,
+		zero:    0,
+		ipProto: ip.proto,
+		length:  20,
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, &pse)
+	binary.Write(&b, binary.BigEndian, h)
 	h.checkSum = checksum(b.Bytes())
 }
 
@@ -118,12 +159,19 @@ func newConstructIpv4(conf Config) Constructor {
 func (c *constructIpv4) Packet(req ConstructPacket) ([]byte, error) {
 	var err error
 	var bts []byte
-	if c.ICMP {
+	protocol := req.Protocol
+	if protocol == "" {
+		protocol = c.protocol()
+	}
+	switch protocol {
+	case ProtoICMP:
 		bts, err = c.packetICMP(req)
-	} else if c.UDP {
+	case ProtoUDP:
 		bts, err = c.packetUDP(req)
-	} else {
-		return nil, fmt.Errorf("no define packet type")
+	case ProtoTCP:
+		bts, err = c.packetTCP(req)
+	default:
+		return nil, fmt.Errorf("no define packet type (%v)", protocol)
 	}
 	if err != nil {
 		return bts, err
@@ -148,9 +196,9 @@ func (c *constructIpv4) packetICMP(req ConstructPacket) ([]byte, error) {
 		id:       req.Id,
 		seq:      req.Seq,
 	}
-	hdICMP.checksum()
+	hdICMP.checksum(req.Payload)
 
-	icmpLen := uint16(8)
+	icmpLen := uint16(8 + len(req.Payload))
 	totalLen := 20 + icmpLen
 	hdIp4.length = totalLen
 	hdIp4.checksum()
@@ -164,6 +212,7 @@ func (c *constructIpv4) packetICMP(req ConstructPacket) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	b.Write(req.Payload)
 	return b.Bytes(), nil
 }
 
@@ -178,12 +227,17 @@ func (c *constructIpv4) packetUDP(req ConstructPacket) ([]byte, error) {
 		srcPort: req.SrcPort,
 		dstPort: req.DstPort,
 	}
-	payload := []byte("a")
+	// leading two bytes are set by seqPayload.
+	payload := append([]byte{0, 0}, req.Payload...)
+	if req.Payload == nil {
+		payload = append(payload, 'a')
+	}
 	udpLen := uint16(8 + len(payload))
 	totalLen := 20 + udpLen
 	hdIp4.length = totalLen
 	hdIp4.checksum()
 	hdUDP.length = udpLen
+	hdUDP.seqPayload(hdIp4, payload, req.Seq)
 	hdUDP.checksum(hdIp4, payload)
 
 	var b bytes.Buffer
@@ -202,6 +256,38 @@ func (c *constructIpv4) packetUDP(req ConstructPacket) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+// packetTCP builds a SYN whose sequence number carries the trace id and the
+// probe sequence, both quoted back by routers and acknowledged by the target.
+func (c *constructIpv4) packetTCP(req ConstructPacket) ([]byte, error) {
+	var err error
+	var hdIp4 *headerIpv4
+	hdIp4, err = c.ipv4Header(req, unix.IPPROTO_TCP)
+	if err != nil {
+		return nil, err
+	}
+	hdTCP := &headerIpv4TCP{
+		srcPort:  req.SrcPort,
+		dstPort:  req.DstPort,
+		seq:      uint32(req.Id)<<16 | uint32(req.Seq),
+		offFlags: 5<<12 | 0x02,
+		window:   65535,
+	}
+	hdIp4.length = 20 + 20
+	hdIp4.checksum()
+	hdTCP.checksum(hdIp4)
+
+	var b bytes.Buffer
+	err = binary.Write(&b, binary.BigEndian, hdIp4)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(&b, binary.BigEndian, hdTCP)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
 func (c *constructIpv4) ipv4Header(req ConstructPacket, proto uint8) (*headerIpv4, error) {
 	ipSrc := net.ParseIP(req.SrcAddr)
 	if ipSrc == nil {
@@ -215,7 +301,7 @@ func (c *constructIpv4) ipv4Header(req ConstructPacket, proto uint8) (*headerIpv
 	ip4Dst := ipDst.To4()
 	hdIp4 := headerIpv4{
 		vhl:      0x45,
-		tos:      0,
+		tos:      req.TOS,
 		length:   0,
 		id:       req.Id,
 		off:      0,
@@ -0,0 +1,109 @@
+package go_mtr
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// CSVEnricher annotates hops from a csv file, like an export of a CMDB. The
+// header names the annotations, its first column holding an address or a
+// prefix: "ip,site,rack" then "10.0.2.1,fra1,r12" and "10.0.3.0/24,ams2,".
+// Addresses match before prefixes, the longest prefix first. Empty cells are
+// left out.
+type CSVEnricher struct {
+	addrs    map[string]map[string]string
+	prefixes []csvPrefix
+}
+
+type csvPrefix struct {
+	net  *net.IPNet
+	bits int
+	ann  map[string]string
+}
+
+func OpenCSVEnricher(path string) (*CSVEnricher, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("load csv (%v) error (%v)", path, err)
+	}
+	defer f.Close()
+	e, err := NewCSVEnricher(f)
+	if err != nil {
+		return nil, fmt.Errorf("load csv (%v) error (%v)", path, err)
+	}
+	return e, nil
+}
+
+func NewCSVEnricher(r io.Reader) (*CSVEnricher, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	head, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	e := &CSVEnricher{
+		addrs: map[string]map[string]string{},
+	}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ann := map[string]string{}
+		for idx := 1; idx < len(row) && idx < len(head); idx++ {
+			if v := strings.TrimSpace(row[idx]); v != "" {
+				ann[strings.TrimSpace(head[idx])] = v
+			}
+		}
+		key := strings.TrimSpace(row[0])
+		if ip := net.ParseIP(key); ip != nil {
+			e.addrs[ip.String()] = ann
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(key)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("line %v invalid addr (%v)", line, key)
+		}
+		bits, _ := ipNet.Mask.Size()
+		e.prefixes = append(e.prefixes, csvPrefix{net: ipNet, bits: bits, ann: ann})
+	}
+	sort.SliceStable(e.prefixes, func(i, j int) bool {
+		return e.prefixes[i].bits > e.prefixes[j].bits
+	})
+	return e, nil
+}
+
+func (e *CSVEnricher) Enrich(ctx context.Context, ip string) (map[string]string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid addr (%v)", ip)
+	}
+	if ann, ok := e.addrs[addr.String()]; ok {
+		return copyAnnotations(ann), nil
+	}
+	for _, p := range e.prefixes {
+		if p.net.Contains(addr) {
+			return copyAnnotations(p.ann), nil
+		}
+	}
+	return nil, nil
+}
+
+func copyAnnotations(ann map[string]string) map[string]string {
+	c := make(map[string]string, len(ann))
+	for k, v := range ann {
+		c[k] = v
+	}
+	return c
+}
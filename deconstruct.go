@@ -10,6 +10,7 @@ const (
 	ICMPEcho        = "ICMPEcho"
 	ICMPTimeExceed  = "ICMPTimeExceed"
 	ICMPUnreachable = "ICMPUnreachable"
+	TCPReply        = "TCPReply"
 )
 
 type DeConstructor interface {
@@ -43,6 +44,10 @@ type ICMPRcv struct {
 	SrcPort   uint16
 	DstPort   uint16
 	Reachable bool
+	// Netns and Interface the reply was received through, when its trace is
+	// bound to them.
+	Netns     string
+	Interface string
 }
 
 type deConstructIpv4 struct {
@@ -73,6 +78,17 @@ func (dc *deConstructIpv4) DeConstruct(pkg []byte) (*ICMPRcv, error) {
 	}
 	_ = ipHeader
 	rcv.RcvAt = time.Now()
+	if ipHeader.proto == 6 {
+		err := dc.rcvTCP(rcv, pkg)
+		if err != nil {
+			return nil, err
+		}
+		return rcv, nil
+	}
+	pkg, err := stripOptions(pkg)
+	if err != nil {
+		return nil, err
+	}
 	controlMsgProto := pkg[20]
 	switch controlMsgProto {
 	case 11:
@@ -87,6 +103,41 @@ func (dc *deConstructIpv4) DeConstruct(pkg []byte) (*ICMPRcv, error) {
 	return rcv, nil
 }
 
+// stripOptions checks an icmp packet is long enough to be decoded, and leaves
+// the ip options of the reply and of the probe quoted by an error out, so the
+// headers are found at fixed offsets: the quoted probe at 28 and its udp, tcp
+// or icmp header at 48.
+func stripOptions(pkg []byte) ([]byte, error) {
+	ihl := int(pkg[0]&0x0f) * 4
+	if ihl < 20 || len(pkg) < ihl+9 {
+		return nil, fmt.Errorf("uncomplete ICMP msg (%v)", pkg)
+	}
+	typ := pkg[ihl]
+	if typ != 11 && typ != 3 {
+		if ihl == 20 {
+			return pkg, nil
+		}
+		return append(append([]byte(nil), pkg[:20]...), pkg[ihl:]...), nil
+	}
+	// the quoted probe, its ip header and the 8 first bytes after it.
+	if len(pkg) < ihl+8+20 {
+		return nil, fmt.Errorf("uncomplete ICMP error (%v)", pkg)
+	}
+	quoted := pkg[ihl+8:]
+	qihl := int(quoted[0]&0x0f) * 4
+	if qihl < 20 || len(quoted) < qihl+8 {
+		return nil, fmt.Errorf("uncomplete ICMP error (%v)", pkg)
+	}
+	if ihl == 20 && qihl == 20 {
+		return pkg, nil
+	}
+	bts := make([]byte, 0, 56)
+	bts = append(bts, pkg[:20]...)
+	bts = append(bts, pkg[ihl:ihl+8]...)
+	bts = append(bts, quoted[:20]...)
+	return append(bts, quoted[qihl:qihl+8]...), nil
+}
+
 func (dc *deConstructIpv4) rcvTtlICMP(rcv *ICMPRcv, bts []byte) {
 	offset := 20
 	rcv.RcvType = ICMPTimeExceed
@@ -96,16 +147,24 @@ func (dc *deConstructIpv4) rcvTtlICMP(rcv *ICMPRcv, bts []byte) {
 	rcv.Src = fmt.Sprintf("%v.%v.%v.%v", bts[offset+20], bts[offset+21], bts[offset+22], bts[offset+23])
 	rcv.Dst = fmt.Sprintf("%v.%v.%v.%v", bts[offset+24], bts[offset+25], bts[offset+26], bts[offset+27])
 	proto := bts[37]
+	rcv.Proto = proto
 	switch proto {
 	case 1:
 		// icmp
 		rcv.Id = binary.BigEndian.Uint16(bts[52:54])
-		rcv.Seq = binary.BigEndian.Uint16(bts[54:57])
+		rcv.Seq = binary.BigEndian.Uint16(bts[54:56])
 	case 17:
-		// udp
+		// udp, the probe sequence is carried in the checksum
 		rcv.Id = binary.BigEndian.Uint16(bts[32:34])
 		rcv.SrcPort = binary.BigEndian.Uint16(bts[48:50])
 		rcv.DstPort = binary.BigEndian.Uint16(bts[50:52])
+		rcv.Seq = binary.BigEndian.Uint16(bts[54:56])
+	case 6:
+		// tcp, the sequence number carries the trace id and probe sequence
+		rcv.Id = binary.BigEndian.Uint16(bts[52:54])
+		rcv.SrcPort = binary.BigEndian.Uint16(bts[48:50])
+		rcv.DstPort = binary.BigEndian.Uint16(bts[50:52])
+		rcv.Seq = binary.BigEndian.Uint16(bts[54:56])
 	}
 }
 
@@ -118,6 +177,7 @@ func (dc *deConstructIpv4) rcvReplyICMP(rcv *ICMPRcv, bts []byte) {
 	rcv.Dst = fmt.Sprintf("%v.%v.%v.%v", bts[12], bts[13], bts[14], bts[15])
 	rcv.Src = fmt.Sprintf("%v.%v.%v.%v", bts[16], bts[17], bts[18], bts[19])
 	rcv.TTLSrc = fmt.Sprintf("%v.%v.%v.%v", bts[12], bts[13], bts[14], bts[15])
+	rcv.Proto = 1
 	rcv.Reachable = true
 }
 
@@ -125,11 +185,57 @@ func (dc *deConstructIpv4) rcvUnreachableICMP(rcv *ICMPRcv, bts []byte) {
 	offset := 20
 	rcv.RcvType = ICMPUnreachable
 	rcv.TTL = bts[offset+8+8]
-	rcv.Dst = fmt.Sprintf("%v.%v.%v.%v", bts[12], bts[13], bts[14], bts[15])
-	rcv.Src = fmt.Sprintf("%v.%v.%v.%v", bts[16], bts[17], bts[18], bts[19])
+	// the quoted packet carries our original addresses, the outer header
+	// only tells who answered, which may be a filtering router on the way.
+	rcv.Src = fmt.Sprintf("%v.%v.%v.%v", bts[offset+20], bts[offset+21], bts[offset+22], bts[offset+23])
+	rcv.Dst = fmt.Sprintf("%v.%v.%v.%v", bts[offset+24], bts[offset+25], bts[offset+26], bts[offset+27])
 	rcv.TTLSrc = fmt.Sprintf("%v.%v.%v.%v", bts[12], bts[13], bts[14], bts[15])
 	rcv.Id = binary.BigEndian.Uint16(bts[32:34])
-	rcv.SrcPort = binary.BigEndian.Uint16(bts[48:50])
-	rcv.DstPort = binary.BigEndian.Uint16(bts[50:52])
+	proto := bts[37]
+	rcv.Proto = proto
+	switch proto {
+	case 1:
+		// icmp
+		rcv.Id = binary.BigEndian.Uint16(bts[52:54])
+		rcv.Seq = binary.BigEndian.Uint16(bts[54:56])
+	case 17:
+		// udp, the probe sequence is carried in the checksum
+		rcv.SrcPort = binary.BigEndian.Uint16(bts[48:50])
+		rcv.DstPort = binary.BigEndian.Uint16(bts[50:52])
+		rcv.Seq = binary.BigEndian.Uint16(bts[54:56])
+	case 6:
+		// tcp, the sequence number carries the trace id and probe sequence
+		rcv.Id = binary.BigEndian.Uint16(bts[52:54])
+		rcv.SrcPort = binary.BigEndian.Uint16(bts[48:50])
+		rcv.DstPort = binary.BigEndian.Uint16(bts[50:52])
+		rcv.Seq = binary.BigEndian.Uint16(bts[54:56])
+	}
+	rcv.Reachable = true
+}
+
+// rcvTCP decodes the SYN-ACK or RST of the target, which acknowledges the
+// sequence number of our SYN.
+func (dc *deConstructIpv4) rcvTCP(rcv *ICMPRcv, bts []byte) error {
+	// any host may send us a short segment, the kernel validates it only
+	// after the raw socket got its copy.
+	offset := int(bts[0]&0x0f) * 4
+	if offset < 20 || len(bts) < offset+20 {
+		return fmt.Errorf("uncomplete tcp segment (%v)", bts)
+	}
+	flags := bts[offset+13]
+	if flags&0x10 == 0 {
+		return fmt.Errorf("tcp segment without ack (%v)", flags)
+	}
+	ack := binary.BigEndian.Uint32(bts[offset+8:offset+12]) - 1
+	rcv.RcvType = TCPReply
+	rcv.Proto = 6
+	rcv.Dst = fmt.Sprintf("%v.%v.%v.%v", bts[12], bts[13], bts[14], bts[15])
+	rcv.Src = fmt.Sprintf("%v.%v.%v.%v", bts[16], bts[17], bts[18], bts[19])
+	rcv.TTLSrc = rcv.Dst
+	rcv.DstPort = binary.BigEndian.Uint16(bts[offset : offset+2])
+	rcv.SrcPort = binary.BigEndian.Uint16(bts[offset+2 : offset+4])
+	rcv.Id = uint16(ack >> 16)
+	rcv.Seq = uint16(ack)
 	rcv.Reachable = true
+	return nil
 }
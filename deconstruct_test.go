@@ -0,0 +1,128 @@
+package go_mtr
+
+import (
+	"runtime"
+	"testing"
+)
+
+// timeExceeded wraps a sent probe the way a router quotes it back to us.
+func timeExceeded(router [4]byte, probe []byte) []byte {
+	return icmpError(11, 0, router, probe)
+}
+
+func icmpError(typ, code uint8, router [4]byte, probe []byte) []byte {
+	bts := make([]byte, 512)
+	bts[0] = 0x45
+	bts[9] = 1
+	copy(bts[12:16], router[:])
+	copy(bts[16:20], probe[12:16])
+	bts[20] = typ
+	bts[21] = code
+	copy(bts[28:], probe)
+	if runtime.GOOS == "darwin" {
+		bts[30], bts[31] = bts[31], bts[30]
+	}
+	return bts
+}
+
+func TestDeconstructSeq(t *testing.T) {
+	tc, err := GetTrace(&Trace{
+		SrcAddr: "10.0.0.1",
+		DstAddr: "10.0.0.9",
+		SrcPort: 65533,
+		DstPort: 65535,
+		MaxTTL:  30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conf := range []Config{{ICMP: true}, {UDP: true}, {TCP: true}} {
+		ct := newConstructIpv4(conf)
+		for _, seq := range []uint16{1, 2, 300, 0xfffe, 0xffff} {
+			bts, err := ct.Packet(ConstructPacket{
+				Trace:   *tc,
+				TTL:     3,
+				Id:      42,
+				Seq:     seq,
+				SrcPort: tc.SrcPort,
+				DstPort: tc.DstPort,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rcv, err := newDeconstructIpv4().DeConstruct(timeExceeded([4]byte{10, 0, 0, 5}, bts))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rcv.Seq != seq || rcv.Id != 42 || rcv.Dst != tc.DstAddr || rcv.TTLSrc != "10.0.0.5" {
+				t.Errorf("%+v decoded %+v, want seq %v", conf, rcv, seq)
+			}
+		}
+	}
+}
+
+func TestDeconstructShortTCP(t *testing.T) {
+	for _, c := range []struct {
+		vhl  byte
+		size int
+	}{
+		{0x45, 30},
+		// ip options push the tcp header out of the packet.
+		{0x46, 40},
+		{0x44, 512},
+	} {
+		bts := make([]byte, c.size)
+		bts[0] = c.vhl
+		bts[9] = protoNumTCP
+		if _, err := newDeconstructIpv4().DeConstruct(bts); err == nil {
+			t.Errorf("short segment %x of %v bytes decoded", c.vhl, c.size)
+		}
+	}
+}
+
+func TestDeconstructShortICMP(t *testing.T) {
+	probe := make([]byte, 28)
+	probe[0] = 0x45
+	probe[9] = protoNumUDP
+	for _, bts := range [][]byte{
+		timeExceeded([4]byte{10, 0, 0, 5}, probe)[:40],
+		icmpError(3, 3, [4]byte{10, 0, 0, 5}, probe)[:50],
+		echoReply(probe)[:28],
+	} {
+		if _, err := newDeconstructIpv4().DeConstruct(bts); err == nil {
+			t.Errorf("short icmp msg of %v bytes decoded", len(bts))
+		}
+	}
+}
+
+func TestDeconstructOptions(t *testing.T) {
+	tc, err := GetTrace(&Trace{SrcAddr: "10.0.0.1", DstAddr: "10.0.0.9", SrcPort: 65533, DstPort: 65535})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bts, err := newConstructIpv4(Config{UDP: true}).Packet(ConstructPacket{
+		Trace:   *tc,
+		TTL:     3,
+		Id:      42,
+		Seq:     300,
+		SrcPort: tc.SrcPort,
+		DstPort: tc.DstPort,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4 bytes of options in the quoted probe and in the reply.
+	withOptions := func(pkg []byte) []byte {
+		bts := append(append(append([]byte(nil), pkg[:20]...), 1, 1, 1, 1), pkg[20:]...)
+		bts[0] = 0x46
+		return bts
+	}
+	msg := withOptions(timeExceeded([4]byte{10, 0, 0, 5}, withOptions(bts))[:28+24+8])
+	rcv, err := newDeconstructIpv4().DeConstruct(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcv.Seq != 300 || rcv.Id != 42 || rcv.Dst != tc.DstAddr || rcv.TTLSrc != "10.0.0.5" || rcv.DstPort != tc.DstPort {
+		t.Fatalf("decoded %+v", rcv)
+	}
+}
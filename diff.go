@@ -0,0 +1,203 @@
+package go_mtr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HopDiff pairs the hop of each path found at the same place, A or B is nil
+// when that path has no hop there. Deltas are B minus A.
+type HopDiff struct {
+	A            *TraceRes
+	B            *TraceRes
+	Same         bool
+	LatencyDelta time.Duration
+	LossDelta    float32
+}
+
+// PathDiff is the difference of two traced paths, from different sources,
+// times or protocols. Hops are aligned by ttl up to the divergence and by
+// router from the convergence on, so the paths may differ in length between.
+type PathDiff struct {
+	A    Trace
+	B    Trace
+	Hops []HopDiff
+	// CommonPrefix is the number of hops both paths share before they
+	// diverge, silent hops do not break it.
+	CommonPrefix int
+	// Diverge is the first ttl the paths differ on, zero when they do not.
+	Diverge uint8
+	// ConvergeA and ConvergeB are the ttls of the first router both paths
+	// meet again on after diverging, zero when they do not.
+	ConvergeA uint8
+	ConvergeB uint8
+}
+
+// DiffPaths compares the aggregated hops of a and b. Hops are keyed by ttl,
+// so paths traced from different start ttls or missing a hop still pair the
+// hops of the same ttl.
+func DiffPaths(a, b TraceResult) PathDiff {
+	ha, hb := diffHops(a), diffHops(b)
+	d := PathDiff{A: a.Trace, B: b.Trace}
+	ttls := map[uint8]bool{}
+	var maxA, maxB int
+	for ttl := range ha {
+		ttls[ttl] = true
+		if int(ttl) > maxA {
+			maxA = int(ttl)
+		}
+	}
+	for ttl := range hb {
+		ttls[ttl] = true
+		if int(ttl) > maxB {
+			maxB = int(ttl)
+		}
+	}
+	var union []int
+	for ttl := range ttls {
+		union = append(union, int(ttl))
+	}
+	sort.Ints(union)
+	for _, ttl := range union {
+		ra, rb := ha[uint8(ttl)], hb[uint8(ttl)]
+		if ra != nil && rb != nil && answered(*ra) && answered(*rb) && !sameHop(*ra, *rb) {
+			d.Diverge = uint8(ttl)
+			break
+		}
+		d.CommonPrefix++
+		d.add(ra, rb)
+	}
+	if d.Diverge == 0 {
+		return d
+	}
+	div := int(d.Diverge)
+	ca, cb := maxA+1, maxB+1
+Converge:
+	for j := div; j <= maxB; j++ {
+		for i := div; i <= maxA; i++ {
+			ra, rb := ha[uint8(i)], hb[uint8(j)]
+			if ra != nil && rb != nil && answered(*ra) && answered(*rb) && sameHop(*ra, *rb) {
+				ca, cb = i, j
+				d.ConvergeA, d.ConvergeB = uint8(i), uint8(j)
+				break Converge
+			}
+		}
+	}
+	d.addRange(ha, hb, div, div, ca, cb)
+	d.addRange(ha, hb, ca, cb, maxA+1, maxB+1)
+	return d
+}
+
+// addRange pairs the hops of a from ttl fromA up to endA with those of b from
+// fromB up to endB, ttl by ttl.
+func (d *PathDiff) addRange(ha, hb map[uint8]*TraceRes, fromA, fromB, endA, endB int) {
+	for k := 0; fromA+k < endA || fromB+k < endB; k++ {
+		var ra, rb *TraceRes
+		if fromA+k < endA {
+			ra = ha[uint8(fromA+k)]
+		}
+		if fromB+k < endB {
+			rb = hb[uint8(fromB+k)]
+		}
+		if ra != nil || rb != nil {
+			d.add(ra, rb)
+		}
+	}
+}
+
+// diffHops are the aggregated hops of r up to the destination, by ttl.
+func diffHops(r TraceResult) map[uint8]*TraceRes {
+	hops := map[uint8]*TraceRes{}
+	for _, h := range r.Aggregate().Res {
+		h := h
+		hops[h.TTL] = &h
+		if h.Reached {
+			break
+		}
+	}
+	return hops
+}
+func answered(r TraceRes) bool {
+	return r.PacketLoss < 1
+}
+
+func sameHop(a, b TraceRes) bool {
+	return intersect(hopHosts(a), hopHosts(b))
+}
+
+func hopHosts(r TraceRes) []string {
+	var hosts []string
+	for _, rs := range r.Stat.Responders {
+		hosts = append(hosts, rs.Host)
+	}
+	if len(hosts) == 0 && r.SrcTTL != "" {
+		hosts = append(hosts, r.SrcTTL)
+	}
+	return hosts
+}
+
+func (d *PathDiff) add(a, b *TraceRes) {
+	h := HopDiff{A: a, B: b}
+	if a != nil && b != nil {
+		h.Same = answered(*a) && answered(*b) && sameHop(*a, *b)
+		h.LossDelta = b.PacketLoss - a.PacketLoss
+		if answered(*a) && answered(*b) {
+			h.LatencyDelta = b.Latency - a.Latency
+		}
+	}
+	d.Hops = append(d.Hops, h)
+}
+
+// SideBySide renders both paths next to each other, '=' marks the hops they
+// share and 'x' those they differ on, silent hops are left unmarked.
+func (d PathDiff) SideBySide() string {
+	line := []string{fmt.Sprintf("%-9s%-2s%-36s%-36s%s", "ttl", "", diffTitle(d.A), diffTitle(d.B), "delta")}
+	for _, h := range d.Hops {
+		ttl := ""
+		switch {
+		case h.A != nil && h.B != nil && h.A.TTL != h.B.TTL:
+			ttl = fmt.Sprintf("%d/%d", h.A.TTL, h.B.TTL)
+		case h.A != nil:
+			ttl = fmt.Sprintf("%d", h.A.TTL)
+		case h.B != nil:
+			ttl = fmt.Sprintf("%d", h.B.TTL)
+		}
+		mark := ""
+		switch {
+		case h.Same:
+			mark = "="
+		case h.A == nil || h.B == nil || answered(*h.A) && answered(*h.B):
+			mark = "x"
+		}
+		delta := ""
+		if h.A != nil && h.B != nil {
+			delta = fmt.Sprintf("%v %+.0f%%", h.LatencyDelta.Round(time.Microsecond), h.LossDelta*100)
+		}
+		line = append(line, fmt.Sprintf("%-9s%-2s%-36s%-36s%s", ttl, mark, diffCell(h.A), diffCell(h.B), delta))
+	}
+	summary := fmt.Sprintf("common prefix:%d", d.CommonPrefix)
+	if d.Diverge != 0 {
+		summary += fmt.Sprintf(" diverge:%d", d.Diverge)
+	}
+	if d.ConvergeA != 0 {
+		summary += fmt.Sprintf(" converge:%d/%d", d.ConvergeA, d.ConvergeB)
+	}
+	line = append(line, summary)
+	return strings.Join(line, "\n")
+}
+
+func diffTitle(t Trace) string {
+	return fmt.Sprintf("%v->%v %v", t.SrcAddr, t.DstAddr, t.Protocol)
+}
+
+func diffCell(r *TraceRes) string {
+	if r == nil {
+		return ""
+	}
+	if !answered(*r) {
+		return "*"
+	}
+	return fmt.Sprintf("%-16s%-10v%.0f%%", r.SrcTTL, r.Latency.Round(time.Microsecond), r.PacketLoss*100)
+}
@@ -0,0 +1,60 @@
+package go_mtr
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffPaths(t *testing.T) {
+	a := routeResult(true, "a", "", "c", "d", "e", "10.0.0.9")
+	b := routeResult(true, "a", "b", "c", "x", "y", "z", "e", "10.0.0.9")
+	b.Res[0].Latency = 3 * time.Millisecond
+	d := DiffPaths(a, b)
+	if d.CommonPrefix != 3 || d.Diverge != 4 || d.ConvergeA != 5 || d.ConvergeB != 7 || len(d.Hops) != 8 {
+		t.Fatalf("unexpected diff\n%v", d.SideBySide())
+	}
+	if !d.Hops[0].Same || d.Hops[0].LatencyDelta != 2*time.Millisecond || d.Hops[1].Same || d.Hops[1].LossDelta != -1 {
+		t.Fatalf("unexpected prefix %+v", d.Hops[:2])
+	}
+	// the divergent segment is one hop long in a, three in b.
+	if d.Hops[3].Same || d.Hops[4].A != nil || d.Hops[5].A != nil || d.Hops[5].B.SrcTTL != "z" {
+		t.Fatalf("unexpected divergence\n%v", d.SideBySide())
+	}
+	if h := d.Hops[6]; !h.Same || h.A.TTL != 5 || h.B.TTL != 7 || !d.Hops[7].Same {
+		t.Fatalf("unexpected convergence\n%v", d.SideBySide())
+	}
+	if s := d.SideBySide(); !strings.Contains(s, "diverge:4 converge:5/7") {
+		t.Fatalf("unexpected render\n%v", s)
+	}
+	if d := DiffPaths(a, a); d.Diverge != 0 || d.CommonPrefix != 6 {
+		t.Fatalf("unexpected diff\n%v", d.SideBySide())
+	}
+}
+
+func TestDiffPathsByTTL(t *testing.T) {
+	b := routeResult(true, "a", "b", "c", "d", "10.0.0.9")
+	// a started at ttl 2 and has no result for ttl 4.
+	a := b
+	a.Res = []TraceRes{b.Res[1], b.Res[2], b.Res[4]}
+	d := DiffPaths(a, b)
+	if d.Diverge != 0 || d.CommonPrefix != 5 || len(d.Hops) != 5 {
+		t.Fatalf("unexpected diff\n%v", d.SideBySide())
+	}
+	if d.Hops[0].A != nil || d.Hops[3].A != nil || d.Hops[3].B.SrcTTL != "d" {
+		t.Fatalf("missing hops not left empty\n%v", d.SideBySide())
+	}
+	for _, idx := range []int{1, 2, 4} {
+		if h := d.Hops[idx]; !h.Same || h.A.TTL != h.B.TTL {
+			t.Fatalf("hop %v not paired by ttl\n%v", idx, d.SideBySide())
+		}
+	}
+	// b diverging after the hop a lacks.
+	b.Res[4].SrcTTL = "x"
+	b.Res[4].Reached = false
+	b.Res = append(b.Res, TraceRes{TTL: 6, SrcTTL: "10.0.0.9", Latency: time.Millisecond, Reached: true})
+	d = DiffPaths(a, b)
+	if d.Diverge != 5 || d.ConvergeA != 5 || d.ConvergeB != 6 {
+		t.Fatalf("unexpected divergence\n%v", d.SideBySide())
+	}
+}
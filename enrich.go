@@ -0,0 +1,104 @@
+package go_mtr
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	enrichTimeout = 2 * time.Second
+	enrichTTL     = 10 * time.Minute
+)
+
+// Enricher annotates a hop address, like with the AS it belongs to. Keys
+// should be namespaced by the enricher, later enrichers of Config.Enrichers
+// override the keys of earlier ones. Enrich is called from the background,
+// once per address until its annotations expire, and may be called
+// concurrently. ctx is done after Config.EnrichTimeout, Enrich should give up
+// by then.
+type Enricher interface {
+	Enrich(ctx context.Context, ip string) (map[string]string, error)
+}
+
+// newEnrichment is the cache of hop annotations, nil without enrichers. The
+// chain runs in the background like reverse dns, once per address.
+func newEnrichment(conf Config) *lookupCache {
+	if len(conf.Enrichers) == 0 {
+		return nil
+	}
+	timeout := conf.EnrichTimeout
+	if timeout <= 0 {
+		timeout = enrichTimeout
+	}
+	enrichers := conf.Enrichers
+	return newLookupCache(func(ctx context.Context, ip string) (interface{}, error) {
+		return enrich(ctx, enrichers, ip), nil
+	}, timeout, 0, enrichTTL)
+}
+
+// annotations of ip when its enrichment is over, it is started otherwise.
+func (c *lookupCache) annotations(ip string) map[string]string {
+	ann, _ := c.peek(ip)
+	m, _ := ann.(map[string]string)
+	return m
+}
+
+// describe names and annotates the hops of a finished trace, waiting for the
+// lookups still running up to their timeout.
+func (t *tracer) describe(tc *TraceResult) {
+	if t.names == nil && t.annotations == nil {
+		return
+	}
+	var ips []string
+	for _, r := range tc.Res {
+		if r.SrcTTL != "" {
+			ips = append(ips, r.SrcTTL)
+		}
+	}
+	start := time.Now()
+	t.names.wait(ips, start)
+	t.annotations.wait(ips, start)
+	for idx := range tc.Res {
+		tc.Res[idx].Hostname = t.names.hostname(tc.Res[idx].SrcTTL)
+		tc.Res[idx].Annotations = t.annotations.annotations(tc.Res[idx].SrcTTL)
+	}
+}
+
+func enrich(ctx context.Context, enrichers []Enricher, ip string) map[string]string {
+	var ann map[string]string
+	for _, e := range enrichers {
+		if ctx.Err() != nil {
+			break
+		}
+		kv, err := e.Enrich(ctx, ip)
+		if err != nil {
+			continue
+		}
+		for k, v := range kv {
+			if ann == nil {
+				ann = map[string]string{}
+			}
+			ann[k] = v
+		}
+	}
+	return ann
+}
+
+func marshalAnnotations(ann map[string]string) string {
+	if len(ann) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(ann))
+	for k := range ann {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var kv []string
+	for _, k := range keys {
+		kv = append(kv, fmt.Sprintf("%v:%v", k, ann[k]))
+	}
+	return strings.Join(kv, " ")
+}
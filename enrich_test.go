@@ -0,0 +1,121 @@
+package go_mtr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countEnricher tags every address with its name and counts the calls.
+type countEnricher struct {
+	name  string
+	delay time.Duration
+	lock  sync.Mutex
+	calls int
+}
+
+func (e *countEnricher) Enrich(ctx context.Context, ip string) (map[string]string, error) {
+	e.lock.Lock()
+	e.calls++
+	e.lock.Unlock()
+	timer := time.NewTimer(e.delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+	}
+	return map[string]string{"by": e.name, e.name: ip}, nil
+}
+
+func TestEnrichChain(t *testing.T) {
+	csv, err := NewCSVEnricher(strings.NewReader("ip,site,rack\n# routers\n10.0.2.1,fra1,r12\n10.0.0.0/8,dc,\n10.0.3.0/24,ams2,r1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := &countEnricher{name: "first"}, &countEnricher{name: "second"}
+	net := &fakeNet{hops: 4}
+	tr := newFakeTracer(Config{
+		ICMP:        true,
+		MaxUnReply:  3,
+		NextHopWait: time.Millisecond * 50,
+		Enrichers:   []Enricher{first, csv, second},
+	}, net)
+	tc := fakeTrace(t)
+	tc.Retry = 2
+	for i := 0; i < 2; i++ {
+		res := tr.BatchTrace([]Trace{tc}, 1)[0]
+		agg := res.Aggregate()
+		want := []string{"site:dc", "rack:r12 second:10.0.2.1 site:fra1", "rack:r1 second:10.0.3.1 site:ams2", "site:dc"}
+		for idx, w := range want {
+			ann := agg.Res[idx].Annotations
+			if ann["by"] != "second" || ann["first"] != agg.Res[idx].SrcTTL || !strings.Contains(marshalAnnotations(ann), w) {
+				t.Fatalf("hop %v annotated %v want %v", idx+1, ann, w)
+			}
+		}
+		if !strings.Contains(agg.MarshalHop(agg.Res[1]), "site:fra1") {
+			t.Fatalf("annotations not marshaled\n%v", agg.Marshal())
+		}
+	}
+	if first.calls != 4 || second.calls != 4 {
+		t.Fatalf("enrichers called %v/%v times for 4 addresses", first.calls, second.calls)
+	}
+}
+
+func TestEnrichAsync(t *testing.T) {
+	slow := &countEnricher{name: "slow", delay: time.Millisecond * 100}
+	net := &fakeNet{hops: 5}
+	tr := newFakeTracer(Config{
+		ICMP:          true,
+		MaxUnReply:    3,
+		NextHopWait:   time.Millisecond * 50,
+		Enrichers:     []Enricher{slow},
+		EnrichTimeout: time.Millisecond * 300,
+	}, net)
+	var hops []TraceRes
+	var probed time.Duration
+	start := time.Now()
+	for ev := range tr.BatchTraceStream(context.Background(), []Trace{fakeTrace(t)}, 1) {
+		if ev.Type == EventHopDone {
+			hops = append(hops, ev.Hop)
+			probed = time.Since(start)
+		}
+	}
+	// probing never waits for the enrichers, the finished trace waits for
+	// them up to EnrichTimeout.
+	if len(hops) != 5 || probed > time.Millisecond*80 || time.Since(start) > time.Millisecond*300 {
+		t.Fatalf("enrichment held the trace %v %v", probed, time.Since(start))
+	}
+	time.Sleep(time.Millisecond * 150)
+	session := NewSession(tr, fakeTrace(t), SessionConfig{Cycles: 1})
+	err := session.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := session.Stats(); len(st) != 5 || st[2].Annotations["slow"] != "10.0.3.1" ||
+		!strings.Contains(session.Marshal(), "slow:10.0.3.1") {
+		t.Fatalf("session not annotated %+v\n%v", st, session.Marshal())
+	}
+}
+
+func TestEnrichTimeout(t *testing.T) {
+	hung := &countEnricher{name: "hung", delay: time.Hour}
+	c := newEnrichment(Config{Enrichers: []Enricher{hung}, EnrichTimeout: time.Millisecond * 20})
+	// more hung lookups than workers, each gives up at its timeout.
+	var entries []*lookupEntry
+	for i := 0; i < lookupWorkers*2; i++ {
+		entries = append(entries, c.start(fmt.Sprintf("10.0.0.%v", i)))
+	}
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	for _, e := range entries {
+		select {
+		case <-e.done:
+		case <-timer.C:
+			t.Fatalf("enricher not given up at the timeout")
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package go_mtr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	AnnotationCountry   = "country"
+	AnnotationCity      = "city"
+	AnnotationLatitude  = "latitude"
+	AnnotationLongitude = "longitude"
+)
+
+// GeoIPDB annotates hops with their location from a GeoLite2 City or Country
+// MMDB file, which is reloaded whenever it changes on disk.
+type GeoIPDB struct {
+	path   string
+	lock   sync.RWMutex
+	reader *maxminddb.Reader
+	// size and modification time of the file loaded.
+	size    int64
+	modTime time.Time
+	stop    chan struct{}
+	once    sync.Once
+}
+
+type geoRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// OpenGeoIPDB loads the MMDB file at path and, when reload is set, checks it
+// for changes every reload until Close.
+func OpenGeoIPDB(path string, reload time.Duration) (*GeoIPDB, error) {
+	db := &GeoIPDB{
+		path: path,
+		stop: make(chan struct{}),
+	}
+	err := db.Reload()
+	if err != nil {
+		return nil, err
+	}
+	if reload > 0 {
+		go db.watch(reload)
+	}
+	return db, nil
+}
+
+// Reload loads the file again, lookups in flight finish on the old one.
+func (db *GeoIPDB) Reload() error {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return fmt.Errorf("load geoip db (%v) error (%v)", db.path, err)
+	}
+	reader, err := maxminddb.Open(db.path)
+	if err != nil {
+		return fmt.Errorf("load geoip db (%v) error (%v)", db.path, err)
+	}
+	db.lock.Lock()
+	old := db.reader
+	db.reader, db.size, db.modTime = reader, info.Size(), info.ModTime()
+	db.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (db *GeoIPDB) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(db.path)
+		if err != nil {
+			continue
+		}
+		db.lock.RLock()
+		changed := info.Size() != db.size || !info.ModTime().Equal(db.modTime)
+		db.lock.RUnlock()
+		if changed {
+			// a file half written fails to load, the next tick tries again.
+			db.Reload()
+		}
+	}
+}
+
+// Enrich annotates ip with AnnotationCountry, its iso code, AnnotationCity in
+// english and AnnotationLatitude and AnnotationLongitude, when the database
+// has them.
+func (db *GeoIPDB) Enrich(ctx context.Context, ip string) (map[string]string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid addr (%v)", ip)
+	}
+	var rec geoRecord
+	db.lock.RLock()
+	if db.reader == nil {
+		db.lock.RUnlock()
+		return nil, fmt.Errorf("geoip db (%v) closed", db.path)
+	}
+	err := db.reader.Lookup(addr, &rec)
+	db.lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	ann := map[string]string{}
+	if rec.Country.IsoCode != "" {
+		ann[AnnotationCountry] = rec.Country.IsoCode
+	}
+	if city := rec.City.Names["en"]; city != "" {
+		ann[AnnotationCity] = city
+	}
+	if rec.Location.Latitude != nil && rec.Location.Longitude != nil {
+		ann[AnnotationLatitude] = strconv.FormatFloat(*rec.Location.Latitude, 'f', -1, 64)
+		ann[AnnotationLongitude] = strconv.FormatFloat(*rec.Location.Longitude, 'f', -1, 64)
+	}
+	if len(ann) == 0 {
+		return nil, nil
+	}
+	return ann, nil
+}
+
+func (db *GeoIPDB) Close() error {
+	db.once.Do(func() {
+		close(db.stop)
+	})
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.reader == nil {
+		return nil
+	}
+	err := db.reader.Close()
+	db.reader = nil
+	return err
+}
@@ -0,0 +1,131 @@
+package go_mtr
+
+import (
+	"context"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mmdbValue encodes v in the MaxMind DB data format.
+func mmdbValue(v interface{}) []byte {
+	ctrl := func(typ, size int) []byte {
+		if typ > 7 {
+			return []byte{byte(size), byte(typ - 7)}
+		}
+		return []byte{byte(typ<<5 | size)}
+	}
+	switch v := v.(type) {
+	case string:
+		return append(ctrl(2, len(v)), v...)
+	case float64:
+		b := ctrl(3, 8)
+		return appendUint32(appendUint32(b, uint32(math.Float64bits(v)>>32)), uint32(math.Float64bits(v)))
+	case uint16:
+		return appendUint16(ctrl(5, 2), v)
+	case uint32:
+		return appendUint32(ctrl(6, 4), v)
+	case []interface{}:
+		b := ctrl(11, len(v))
+		for _, e := range v {
+			b = append(b, mmdbValue(e)...)
+		}
+		return b
+	case map[string]interface{}:
+		b := ctrl(7, len(v))
+		for k, e := range v {
+			b = append(b, mmdbValue(k)...)
+			b = append(b, mmdbValue(e)...)
+		}
+		return b
+	}
+	panic(v)
+}
+
+// mmdb is an ipv4 database with rec as the only record, for prefix.
+func mmdb(prefix string, rec map[string]interface{}) []byte {
+	_, ipNet, _ := net.ParseCIDR(prefix)
+	bits, _ := ipNet.Mask.Size()
+	ip := ipNet.IP.To4()
+	nodes := uint32(bits)
+	var tree []byte
+	for i := 0; i < bits; i++ {
+		next := uint32(i + 1)
+		if i == bits-1 {
+			next = nodes + 16
+		}
+		records := [2]uint32{nodes, nodes}
+		records[ip[i/8]>>(7-uint(i%8))&1] = next
+		for _, r := range records {
+			tree = append(tree, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	db := append(tree, make([]byte, 16)...)
+	db = append(db, mmdbValue(rec)...)
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	return append(db, mmdbValue(map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"database_type":               "GeoLite2-City",
+		"ip_version":                  uint16(4),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  nodes,
+		"record_size":                 uint16(24),
+	})...)
+}
+
+func geoCity(iso, city string, lat, lon float64) map[string]interface{} {
+	return map[string]interface{}{
+		"country":  map[string]interface{}{"iso_code": iso},
+		"city":     map[string]interface{}{"names": map[string]interface{}{"en": city}},
+		"location": map[string]interface{}{"latitude": lat, "longitude": lon},
+	}
+}
+
+func TestGeoIPDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	err := os.WriteFile(path, mmdb("10.0.2.0/24", geoCity("DE", "Berlin", 52.5, 13.4)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenGeoIPDB(path, time.Millisecond*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	net := &fakeNet{hops: 3}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 50, Enrichers: []Enricher{db}}, net)
+	res := tr.BatchTrace([]Trace{fakeTrace(t)}, 1)[0]
+	ann := res.Res[1].Annotations
+	if ann[AnnotationCountry] != "DE" || ann[AnnotationCity] != "Berlin" || ann[AnnotationLatitude] != "52.5" ||
+		ann[AnnotationLongitude] != "13.4" || res.Res[0].Annotations != nil {
+		t.Fatalf("unexpected annotations\n%v", res.Marshal())
+	}
+	// replace the file the way updaters do, the watcher picks it up.
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, mmdb("10.0.2.0/24", geoCity("FR", "Paris", 48.9, 2.4)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		ann, err := db.Enrich(context.Background(), "10.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ann[AnnotationCity] == "Paris" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("geoip db not reloaded %v", ann)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -3,6 +3,7 @@ module github.com/wisdomatom/go-mtr
 go 1.17
 
 require (
+	github.com/oschwald/maxminddb-golang v1.3.1
 	github.com/spf13/cobra v0.0.5
 	golang.org/x/sys v0.6.0
 )
@@ -0,0 +1,77 @@
+package go_mtr
+
+import (
+	"fmt"
+	"sync"
+)
+
+// idAllocator hands out trace ids which no live trace of the same flow uses.
+// Replies are told apart by the flow (protocol, addresses and ports) and the
+// id together, so 65535 traces of each flow may run at once, 0 is never handed
+// out as the kernel fills a zero ip id of udp probes in itself. The cursor is
+// shared by every flow, an id is only handed out again after the others, which
+// keeps late replies of a finished trace away from a new one.
+type idAllocator struct {
+	lock   sync.Mutex
+	cursor uint16
+	live   map[string]map[uint16]struct{}
+}
+
+var errIdExhausted = fmt.Errorf("every trace id of the flow is in use")
+
+func newIdAllocator() *idAllocator {
+	return &idAllocator{
+		live: map[string]map[uint16]struct{}{},
+	}
+}
+
+func flowKey(proto uint8, src string, srcPort uint16, dst string, dstPort uint16) string {
+	if proto == protoNumICMP {
+		srcPort, dstPort = 0, 0
+	}
+	return fmt.Sprintf("%v:%v:%v-%v:%v", proto, src, srcPort, dst, dstPort)
+}
+
+// flow of the probes of t.
+func (t Trace) flow() string {
+	return flowKey(protoNumber(t.Protocol), t.SrcAddr, t.SrcPort, t.DstAddr, t.DstPort)
+}
+
+func (a *idAllocator) acquire(flow string) (uint16, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	live, ok := a.live[flow]
+	if !ok {
+		live = map[uint16]struct{}{}
+		a.live[flow] = live
+	}
+	for i := 0; i < 0xffff; i++ {
+		a.cursor++
+		if a.cursor == 0 {
+			a.cursor++
+		}
+		if _, ok := live[a.cursor]; !ok {
+			live[a.cursor] = struct{}{}
+			return a.cursor, nil
+		}
+	}
+	return 0, errIdExhausted
+}
+
+// inUse tells whether a live trace probes flow.
+func (a *idAllocator) inUse(flow string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, ok := a.live[flow]
+	return ok
+}
+
+func (a *idAllocator) release(flow string, id uint16) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	live := a.live[flow]
+	delete(live, id)
+	if len(live) == 0 {
+		delete(a.live, flow)
+	}
+}
@@ -0,0 +1,29 @@
+package go_mtr
+
+import "testing"
+
+func TestIdAllocator(t *testing.T) {
+	a := newIdAllocator()
+	flow := flowKey(protoNumUDP, "10.0.0.1", 1, "10.0.0.9", 2)
+	seen := map[uint16]bool{}
+	for i := 0; i < 0xffff; i++ {
+		id, err := a.acquire(flow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == 0 || seen[id] {
+			t.Fatalf("id %v handed out twice or zero", id)
+		}
+		seen[id] = true
+	}
+	if _, err := a.acquire(flow); err != errIdExhausted {
+		t.Fatalf("expect exhausted, got %v", err)
+	}
+	if _, err := a.acquire(flowKey(protoNumUDP, "10.0.0.1", 1, "10.0.0.9", 3)); err != nil {
+		t.Fatalf("other flows must not be limited, got %v", err)
+	}
+	a.release(flow, 42)
+	if id, err := a.acquire(flow); err != nil || id != 42 {
+		t.Fatalf("expect released id back, got %v %v", id, err)
+	}
+}
@@ -0,0 +1,183 @@
+package go_mtr
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenKey is where the replies of a trace arrive, its network namespace
+// and interface.
+type listenKey struct {
+	netns string
+	iface string
+}
+
+func (t Trace) listenKey() listenKey {
+	return listenKey{netns: t.Netns, iface: t.Interface}
+}
+
+func (k listenKey) String() string {
+	var s string
+	if k.iface != "" {
+		s += "%" + k.iface
+	}
+	if k.netns != "" {
+		s += "@" + k.netns
+	}
+	return s
+}
+
+// listener holds the sockets of a netns or interface, opened by the first
+// trace sent through it and closed once the last one is over, so a netns
+// gone with its tenant is not kept alive. The receivers of the tracer are not
+// bound and may see the same replies, which then match no trace.
+type listener struct {
+	refs        int
+	receiver    Receiver
+	tcpReceiver Receiver
+	// send sockets by fwmark, switching netns for every probe is too slow.
+	send map[uint32]*sendSocket
+}
+
+// listen takes a reference on the listener of key for a trace of flow,
+// opening its icmp receiver and its tcp one with tcp.
+func (t *tracer) listen(key listenKey, flow string, tcp bool) error {
+	t.listenersMu.Lock()
+	defer t.listenersMu.Unlock()
+	if t.listeners == nil {
+		t.listeners = map[listenKey]*listener{}
+		t.boundFlows = map[string]int{}
+	}
+	l, ok := t.listeners[key]
+	if !ok {
+		l = &listener{send: map[uint32]*sendSocket{}}
+		t.listeners[key] = l
+	}
+	var err error
+	if l.receiver == nil {
+		l.receiver, err = t.receiveOn(unix.IPPROTO_ICMP, key)
+	}
+	if err == nil && tcp && l.tcpReceiver == nil {
+		l.tcpReceiver, err = t.receiveOn(unix.IPPROTO_TCP, key)
+	}
+	if err != nil {
+		if l.refs == 0 {
+			l.close()
+			delete(t.listeners, key)
+		}
+		return fmt.Errorf("listen on (%v) error (%v)", key, err)
+	}
+	l.refs++
+	t.boundFlows[flow]++
+	return nil
+}
+
+// unlisten drops a reference taken by listen, the last one closes the
+// sockets of key.
+func (t *tracer) unlisten(key listenKey, flow string) {
+	t.listenersMu.Lock()
+	defer t.listenersMu.Unlock()
+	l, ok := t.listeners[key]
+	if !ok {
+		return
+	}
+	t.boundFlows[flow]--
+	if t.boundFlows[flow] <= 0 {
+		delete(t.boundFlows, flow)
+	}
+	l.refs--
+	if l.refs > 0 {
+		return
+	}
+	l.close()
+	delete(t.listeners, key)
+}
+
+// sendSocket is the socket probes of key marked mark are sent from, the
+// caller must hold a reference on the listener of key.
+func (t *tracer) sendSocket(key listenKey, mark uint32) (*sendSocket, error) {
+	t.listenersMu.Lock()
+	defer t.listenersMu.Unlock()
+	l, ok := t.listeners[key]
+	if !ok {
+		return nil, fmt.Errorf("no listener of (%v)", key)
+	}
+	sock, ok := l.send[mark]
+	if ok {
+		return sock, nil
+	}
+	sock, err := t.openSender(key, mark)
+	if err != nil {
+		return nil, err
+	}
+	l.send[mark] = sock
+	return sock, nil
+}
+
+// unmatchedElsewhere tells whether a reply matching no trace was expected
+// to, as the same reply reaches the host receivers and those of the netns or
+// interface of its trace.
+func (t *tracer) unmatchedElsewhere(rcv *ICMPRcv) bool {
+	flow := flowKey(rcv.Proto, rcv.Src, rcv.SrcPort, rcv.Dst, rcv.DstPort)
+	if rcv.Netns != "" || rcv.Interface != "" {
+		return t.ids.inUse(flow)
+	}
+	t.listenersMu.Lock()
+	defer t.listenersMu.Unlock()
+	return t.boundFlows[flow] > 0
+}
+
+func (t *tracer) receiveOn(proto int, key listenKey) (Receiver, error) {
+	rcv, err := t.openReceiver(proto, key)
+	if err != nil {
+		return nil, err
+	}
+	ch := rcv.Receive()
+	go func() {
+		for msg := range ch {
+			rcv, err := t.ipv4.deConstructor.DeConstruct(msg)
+			if err != nil {
+				continue
+			}
+			rcv.Netns = key.netns
+			rcv.Interface = key.iface
+			t.handleRcv(rcv)
+		}
+	}()
+	return rcv, nil
+}
+
+func (l *listener) close() {
+	if l.receiver != nil {
+		l.receiver.Close()
+	}
+	if l.tcpReceiver != nil {
+		l.tcpReceiver.Close()
+	}
+	for _, sock := range l.send {
+		sock.Close()
+	}
+}
+
+func (t *tracer) closeListeners() {
+	t.listenersMu.Lock()
+	defer t.listenersMu.Unlock()
+	for _, l := range t.listeners {
+		l.close()
+	}
+	t.listeners = nil
+	t.boundFlows = nil
+}
+
+func openReceiver(proto int, key listenKey) (Receiver, error) {
+	return newRcvIpv4Proto(proto, key.netns, key.iface)
+}
+
+func openSender(key listenKey, mark uint32) (*sendSocket, error) {
+	fd, err := openSendSocket(key.netns, key.iface, mark)
+	if err != nil {
+		return nil, err
+	}
+	return &sendSocket{fd: fd}, nil
+}
@@ -0,0 +1,153 @@
+package go_mtr
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// lookupRetry is how long a failed lookup is kept before it is tried again.
+	lookupRetry = time.Minute
+	// lookupWorkers bounds the lookups running at once, the others queue.
+	lookupWorkers = 8
+)
+
+// lookupCache looks ip addresses up in the background, at most rate a second
+// and each within timeout, and keeps the results for ttl so every address is
+// looked up once however many hops and traces it shows up in.
+type lookupCache struct {
+	lookup  func(ctx context.Context, ip string) (interface{}, error)
+	timeout time.Duration
+	ttl     time.Duration
+	bucket  *tokenBucket
+	lock    sync.Mutex
+	entries map[string]*lookupEntry
+	// queue of the lookups waiting for one of the workers, which exit once
+	// it is empty.
+	queue   []*lookupEntry
+	workers int
+}
+
+type lookupEntry struct {
+	ip     string
+	done   chan struct{}
+	value  interface{}
+	err    error
+	expire time.Time
+}
+
+func newLookupCache(lookup func(ctx context.Context, ip string) (interface{}, error), timeout time.Duration, rate float64, ttl time.Duration) *lookupCache {
+	c := &lookupCache{
+		lookup:  lookup,
+		timeout: timeout,
+		ttl:     ttl,
+		entries: map[string]*lookupEntry{},
+	}
+	if rate > 0 {
+		c.bucket = &tokenBucket{
+			rate:   rate,
+			burst:  1,
+			tokens: 1,
+			last:   time.Now(),
+		}
+	}
+	return c
+}
+
+// start looks ip up unless it is cached or already being looked up.
+func (c *lookupCache) start(ip string) *lookupEntry {
+	if c == nil || ip == "" {
+		return nil
+	}
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[ip]
+	if ok && (e.expire.IsZero() || now.Before(e.expire)) {
+		return e
+	}
+	if len(c.entries) > 4096 {
+		for k, e := range c.entries {
+			if !e.expire.IsZero() && e.expire.Before(now) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	e = &lookupEntry{ip: ip, done: make(chan struct{})}
+	c.entries[ip] = e
+	c.queue = append(c.queue, e)
+	if c.workers < lookupWorkers {
+		c.workers++
+		go c.work()
+	}
+	return e
+}
+
+func (c *lookupCache) work() {
+	for {
+		c.lock.Lock()
+		if len(c.queue) == 0 {
+			c.workers--
+			c.lock.Unlock()
+			return
+		}
+		e := c.queue[0]
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		c.lock.Unlock()
+		c.run(e)
+	}
+}
+
+func (c *lookupCache) run(e *lookupEntry) {
+	if c.bucket != nil {
+		time.Sleep(time.Until(c.bucket.reserve(time.Now())))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	value, err := c.lookup(ctx, e.ip)
+	cancel()
+	ttl := c.ttl
+	if err != nil {
+		ttl = lookupRetry
+	}
+	c.lock.Lock()
+	e.value, e.err, e.expire = value, err, time.Now().Add(ttl)
+	c.lock.Unlock()
+	close(e.done)
+}
+
+// peek returns the value of ip once its lookup succeeded, it never waits.
+func (c *lookupCache) peek(ip string) (interface{}, bool) {
+	e := c.start(ip)
+	if e == nil {
+		return nil, false
+	}
+	select {
+	case <-e.done:
+		return e.value, e.err == nil
+	default:
+		return nil, false
+	}
+}
+
+// wait blocks until the lookups of ips are over, at most until timeout after
+// start.
+func (c *lookupCache) wait(ips []string, start time.Time) {
+	if c == nil {
+		return
+	}
+	timer := time.NewTimer(time.Until(start.Add(c.timeout)))
+	defer timer.Stop()
+	for _, ip := range ips {
+		e := c.start(ip)
+		if e == nil {
+			continue
+		}
+		select {
+		case <-e.done:
+		case <-timer.C:
+			return
+		}
+	}
+}
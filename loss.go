@@ -0,0 +1,161 @@
+package go_mtr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// lossPacedProbes is the least probes a pacing probe sends to a hop.
+const lossPacedProbes = 5
+
+// HopLoss is the loss of one aggregated hop as seen by the loss analysis.
+type HopLoss struct {
+	TTL  uint8
+	Host string
+	Snt  int
+	Loss float32
+	// Propagated is false when a later hop lost less, the router then only
+	// drops the probes expiring on itself, mostly icmp rate limiting of its
+	// control plane, while it forwards the traffic fine.
+	Propagated bool
+	// Paced is set once the hop was probed again slowly, PacedLoss being the
+	// loss of those probes.
+	Paced     bool
+	PacedLoss float32
+	// RateLimited confirms a loss not propagated, the slow probes lost less.
+	RateLimited bool
+}
+
+type LossAnalysis struct {
+	Hops []HopLoss
+	// EndToEndLoss is the loss of the probes which reached the destination,
+	// all of them are lost when it was never reached.
+	EndToEndLoss float32
+}
+
+// AnalyzeLoss tells the loss of every hop which is seen by the hops behind it,
+// real forwarding loss, from the loss of a router answering only part of the
+// probes expiring on it.
+func (t TraceResult) AnalyzeLoss() LossAnalysis {
+	agg := t.Aggregate()
+	la := LossAnalysis{EndToEndLoss: 1}
+	for _, r := range agg.Res {
+		la.Hops = append(la.Hops, HopLoss{
+			TTL:        r.TTL,
+			Host:       r.SrcTTL,
+			Snt:        r.Stat.Snt,
+			Loss:       r.PacketLoss,
+			Propagated: true,
+		})
+		if r.Reached {
+			la.EndToEndLoss = r.PacketLoss
+		}
+	}
+	// walk back from the last hop keeping the lowest loss seen behind each hop.
+	var behind float32 = 1
+	for idx := len(la.Hops) - 1; idx >= 0; idx-- {
+		h := &la.Hops[idx]
+		if h.Loss > behind {
+			h.Propagated = false
+		}
+		if h.Loss < behind {
+			behind = h.Loss
+		}
+	}
+	return la
+}
+
+// ConfirmLoss analyzes the loss of res and probes every hop whose loss is not
+// propagated again, one probe every pacing, to confirm the router limits the
+// rate it answers at.
+func (t *tracer) ConfirmLoss(ctx context.Context, res TraceResult, pacing time.Duration) LossAnalysis {
+	la := res.AnalyzeLoss()
+	var suspects []int
+	for idx, h := range la.Hops {
+		if h.Loss > 0 && !h.Propagated {
+			suspects = append(suspects, idx)
+		}
+	}
+	if len(suspects) == 0 {
+		return la
+	}
+	t.pool.enqueue(1)
+	err := t.pool.acquire(ctx, res.Priority)
+	if err != nil {
+		t.pool.drop(1)
+		return la
+	}
+	defer t.pool.release()
+	b := res.Trace
+	b.Retry = 1
+	tc, err := t.newTraceResult(b)
+	if err != nil || t.listenFor(tc.Trace) != nil {
+		return la
+	}
+	if t.assignId(tc) != nil {
+		t.unlistenFor(tc.Trace)
+		return la
+	}
+	run := t.newRun(ctx, tc, func(TraceEvent) {})
+	defer t.closeRun(run)
+	for _, idx := range suspects {
+		h := &la.Hops[idx]
+		n := h.Snt
+		if n < lossPacedProbes {
+			n = lossPacedProbes
+		}
+		sent, lost := 0, 0
+		for i := 0; i < n; i++ {
+			if i > 0 && !sleepContext(ctx, pacing) {
+				break
+			}
+			replied := t.probeTTL(run, h.TTL)
+			if tc.Cancelled {
+				break
+			}
+			sent++
+			if !replied {
+				lost++
+			}
+		}
+		if sent == 0 {
+			break
+		}
+		h.Paced = true
+		h.PacedLoss = float32(lost) / float32(sent)
+		h.RateLimited = h.PacedLoss < h.Loss
+	}
+	return la
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (la LossAnalysis) Marshal() string {
+	var line []string
+	for _, h := range la.Hops {
+		l := fmt.Sprintf("%-8d| hop:%-16s| loss:%.2f", h.TTL, h.Host, h.Loss)
+		if !h.Propagated {
+			l += " not propagated"
+		}
+		if h.Paced {
+			l += fmt.Sprintf(" paced loss:%.2f", h.PacedLoss)
+		}
+		if h.RateLimited {
+			l += " rate limited"
+		}
+		line = append(line, l)
+	}
+	line = append(line, fmt.Sprintf("end to end loss:%.2f", la.EndToEndLoss))
+	return strings.Join(line, "\n")
+}
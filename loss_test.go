@@ -0,0 +1,51 @@
+package go_mtr
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func lossResult(t *testing.T) TraceResult {
+	return TraceResult{
+		Trace: fakeTrace(t),
+		Res: []TraceRes{
+			{TTL: 1, SrcTTL: "10.0.1.1", Latency: time.Millisecond},
+			{TTL: 1, SrcTTL: "10.0.1.1", Latency: time.Millisecond},
+			{TTL: 2, PacketLoss: 1},
+			{TTL: 2, PacketLoss: 1},
+			{TTL: 3, SrcTTL: "10.0.3.1", Latency: time.Millisecond},
+			{TTL: 3, PacketLoss: 1},
+			{TTL: 4, SrcTTL: "10.0.0.9", Latency: time.Millisecond, Reached: true},
+			{TTL: 4, PacketLoss: 1},
+		},
+	}
+}
+
+func TestAnalyzeLoss(t *testing.T) {
+	la := lossResult(t).AnalyzeLoss()
+	if len(la.Hops) != 4 || la.EndToEndLoss != 0.5 {
+		t.Fatalf("unexpected analysis\n%v", la.Marshal())
+	}
+	for idx, want := range []bool{true, false, true, true} {
+		if la.Hops[idx].Propagated != want {
+			t.Fatalf("hop %v propagated want %v\n%v", idx+1, want, la.Marshal())
+		}
+	}
+	if la := (TraceResult{Res: lossResult(t).Res[:6]}).AnalyzeLoss(); la.EndToEndLoss != 1 {
+		t.Fatalf("unreached destination\n%v", la.Marshal())
+	}
+}
+
+func TestConfirmLoss(t *testing.T) {
+	net := &fakeNet{hops: 4}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 50}, net)
+	la := tr.ConfirmLoss(context.Background(), lossResult(t), time.Millisecond)
+	h := la.Hops[1]
+	if !h.Paced || h.PacedLoss != 0 || !h.RateLimited || la.Hops[2].Paced {
+		t.Fatalf("unexpected analysis\n%v", la.Marshal())
+	}
+	if st := tr.Stats(); st.Running != 0 || st.Unmatched != 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
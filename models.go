@@ -6,30 +6,156 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+const (
+	ProtoICMP = "icmp"
+	ProtoUDP  = "udp"
+	ProtoTCP  = "tcp"
+)
+
+const (
+	protoNumICMP uint8 = 1
+	protoNumTCP  uint8 = 6
+	protoNumUDP  uint8 = 17
+)
+
+// Config holds the tracer wide settings, ICMP/TCP/UDP, MaxUnReply and
+// NextHopWait are the defaults of traces which do not set their own.
 type Config struct {
 	ICMP        bool
 	TCP         bool
 	UDP         bool
 	MaxUnReply  int
 	NextHopWait time.Duration
+	// TTLWindow is how many probes are kept in flight across the ttl range,
+	// zero or one probes hop by hop waiting NextHopWait for each.
+	TTLWindow int
+	// ProbeRate limits the probes per second of the whole tracer, with bursts
+	// of up to ProbeBurst. Zero sends as fast as traces ask.
+	ProbeRate  float64
+	ProbeBurst int
+	// PrefixPacing is the minimum gap between probes to destinations sharing
+	// a PrefixLen prefix, /24 for ipv4 and /48 for ipv6 when unset.
+	PrefixPacing time.Duration
+	PrefixLen    int
+	// HopPacing is the minimum gap between probes expected to expire on the
+	// same router, as learned from earlier replies.
+	HopPacing time.Duration
+	// MaxConcurrentTraces bounds the traces probing at once, the others wait
+	// their turn by Trace.Priority. Zero starts every trace right away.
+	MaxConcurrentTraces int
+	// Percentiles is the default of Trace.Percentiles.
+	Percentiles []float64
+	// ReverseDNS names the hops in the background, probing never waits for
+	// it. Lookups take at most ReverseDNSTimeout, 2s when unset, and run at
+	// most ReverseDNSRate a second, 20 when unset. Names are cached.
+	ReverseDNS        bool
+	ReverseDNSTimeout time.Duration
+	ReverseDNSRate    float64
+	// PTRResolver looks the names up, net.DefaultResolver when nil.
+	PTRResolver PTRResolver
+	// Enrichers annotate the hops in the background, like ReverseDNS names
+	// them. Annotating an address takes at most EnrichTimeout, 2s when unset,
+	// finished traces wait for annotations still running.
+	Enrichers     []Enricher
+	EnrichTimeout time.Duration
+	// GeoIPDB is a MMDB file the tracer annotates hops from after Enrichers,
+	// checked for changes every GeoIPReload when set.
+	GeoIPDB     string
+	GeoIPReload time.Duration
+	// Mark is the default of Trace.Mark, traces GetTrace picked the source of
+	// get it again from the marked route.
+	Mark uint32
 }
 
+const (
+	FamilyIPv4 = "ip4"
+	FamilyIPv6 = "ip6"
+)
+
 type Trace struct {
-	IsIpv4      bool
-	SrcAddr     string
-	DstAddr     string
+	IsIpv4 bool
+	// SrcAddr is filled by GetTrace from the routing table when empty.
+	SrcAddr string
+	// DstAddr is an address or a host name GetTrace resolves, the name is
+	// then kept in DstName.
+	DstAddr string
+	DstName string
+	// Family picks the address of a host name, FamilyIPv4 or FamilyIPv6, the
+	// family of SrcAddr when unset and ipv4 first without SrcAddr.
+	Family string
+	// Resolver resolves host names, DefaultResolver when nil.
+	Resolver Resolver
+	// Interface is the interface or vrf probes are sent out and replies are
+	// received through, like "eth1" or "vrf-blue". Empty lets routing pick.
+	Interface string
+	// Netns is the network namespace probes are sent and received in, a path
+	// like /var/run/netns/blue or the pid of a process inside it. Empty is
+	// the namespace of the program.
+	Netns string
+	// Mark is the fwmark probes are sent with, so they follow the ip rules of
+	// the traffic marked alike, Config.Mark when zero. Replies are received
+	// whatever their mark. GetTrace picks SrcAddr from the route of this mark.
+	Mark        uint32
 	SrcSockAddr unix.Sockaddr
 	DstSockAddr unix.Sockaddr
 	SrcPort     uint16
 	DstPort     uint16
 	MaxTTL      uint8
 	Retry       int
+	// Timeout bounds the whole trace, zero means no limit besides MaxTTL.
+	Timeout time.Duration
+	// Priority orders traces waiting for Config.MaxConcurrentTraces, higher first.
+	Priority int
+	// Protocol is one of ProtoICMP, ProtoUDP or ProtoTCP.
+	Protocol    string
+	NextHopWait time.Duration
+	MaxUnReply  int
+	// Payload is appended to icmp and udp probes, udp probes carry two more
+	// bytes in front of it to set their checksum. tcp probes are bare SYNs.
+	Payload []byte
+	TOS     uint8
+	// Percentiles of the round trip time computed for aggregated hops, like 95 for p95.
+	Percentiles []float64
+	// srcRouted is set when GetTrace picked SrcAddr.
+	srcRouted bool
 }
 
 type TraceRes struct {
-	SrcTTL     string
+	SrcTTL string
+	// Hostname is the name of SrcTTL, when Config.ReverseDNS found one.
+	Hostname   string
 	Latency    time.Duration
 	TTL        uint8
 	Reached    bool
 	PacketLoss float32
+	// Late is set when the reply came after NextHopWait, the hop and latency
+	// still belong to the ttl the probe was sent with.
+	Late bool
+	// Stat is filled on aggregated hops only.
+	Stat HopStat
+	// Annotations of SrcTTL by Config.Enrichers.
+	Annotations map[string]string
+}
+
+func (c Config) protocol() string {
+	if c.ICMP {
+		return ProtoICMP
+	}
+	if c.UDP {
+		return ProtoUDP
+	}
+	if c.TCP {
+		return ProtoTCP
+	}
+	return ProtoICMP
+}
+
+func protoNumber(protocol string) uint8 {
+	switch protocol {
+	case ProtoTCP:
+		return protoNumTCP
+	case ProtoUDP:
+		return protoNumUDP
+	}
+	return protoNumICMP
 }
@@ -0,0 +1,195 @@
+package go_mtr
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RouteHopAdded      = "HopAdded"
+	RouteHopRemoved    = "HopRemoved"
+	RouteHopReplaced   = "HopReplaced"
+	RouteLengthChanged = "LengthChanged"
+	RouteUnreachable   = "Unreachable"
+)
+
+type RouteMonitorConfig struct {
+	// Similarity is the share of the compared hops which must still match a
+	// known router for the path to be the same, below it the hops which
+	// changed are reported. Zero requires every hop to match.
+	Similarity float64
+}
+
+// RouteChange is one difference between the known path of a target and the
+// one just traced. Old and New are the routers of TTL, or the path length for
+// RouteLengthChanged.
+type RouteChange struct {
+	Type     string
+	SrcAddr  string
+	DstAddr  string
+	Protocol string
+	TTL      uint8
+	Old      []string
+	New      []string
+	OldLen   uint8
+	NewLen   uint8
+	At       time.Time
+}
+
+// RouteMonitor keeps the last known path of every (source, destination,
+// protocol) and reports how the results of later traces change it.
+type RouteMonitor struct {
+	conf  RouteMonitorConfig
+	lock  sync.Mutex
+	paths map[string]*routePath
+}
+
+type routePath struct {
+	// routers every ttl was answered by, routers seen while the path was
+	// similar are kept as ecmp alternates.
+	hops    map[uint8][]string
+	length  uint8
+	reached bool
+}
+
+func NewRouteMonitor(conf RouteMonitorConfig) *RouteMonitor {
+	if conf.Similarity <= 0 {
+		conf.Similarity = 1
+	}
+	return &RouteMonitor{
+		conf:  conf,
+		paths: map[string]*routePath{},
+	}
+}
+
+func routeKey(src, dst, proto string) string {
+	return fmt.Sprintf("%v/%v/%v", src, dst, proto)
+}
+
+// Observe compares res with the known path of its target, then makes it the
+// known path. The first result of a target, cancelled ones and those which
+// failed with Err report nothing.
+func (m *RouteMonitor) Observe(res TraceResult) []RouteChange {
+	if res.Cancelled || res.Err != nil {
+		return nil
+	}
+	path := newRoutePath(res)
+	key := routeKey(res.SrcAddr, res.DstAddr, res.Protocol)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	old, ok := m.paths[key]
+	if !ok {
+		m.paths[key] = path
+		return nil
+	}
+	change := RouteChange{
+		SrcAddr:  res.SrcAddr,
+		DstAddr:  res.DstAddr,
+		Protocol: res.Protocol,
+		OldLen:   old.length,
+		NewLen:   path.length,
+		At:       time.Now(),
+	}
+	var changes []RouteChange
+	var matched, compared int
+	last := old.length
+	if path.length > last {
+		last = path.length
+	}
+	for ttl := uint8(1); ttl != 0 && ttl <= last; ttl++ {
+		o, n := old.hops[ttl], path.hops[ttl]
+		c := change
+		c.TTL, c.Old, c.New = ttl, o, n
+		switch {
+		case len(o) > 0 && len(n) > 0:
+			compared++
+			if intersect(o, n) {
+				matched++
+				continue
+			}
+			c.Type = RouteHopReplaced
+		case len(n) > 0 && ttl > old.length:
+			compared++
+			c.Type = RouteHopAdded
+		case len(o) > 0 && ttl > path.length:
+			compared++
+			c.Type = RouteHopRemoved
+		default:
+			// a silent hop tells nothing about the path.
+			continue
+		}
+		changes = append(changes, c)
+	}
+	similar := compared == 0 || float64(matched)/float64(compared) >= m.conf.Similarity
+	if similar {
+		changes = nil
+		path.learn(old)
+	}
+	if old.length != path.length {
+		c := change
+		c.Type = RouteLengthChanged
+		changes = append(changes, c)
+	}
+	if old.reached && !path.reached {
+		c := change
+		c.Type = RouteUnreachable
+		changes = append(changes, c)
+	}
+	m.paths[key] = path
+	return changes
+}
+
+func newRoutePath(res TraceResult) *routePath {
+	path := &routePath{hops: map[uint8][]string{}}
+	for _, r := range res.Aggregate().Res {
+		if path.reached {
+			break
+		}
+		for _, rs := range r.Stat.Responders {
+			path.hops[r.TTL] = append(path.hops[r.TTL], rs.Host)
+		}
+		if len(path.hops[r.TTL]) > 0 {
+			path.length = r.TTL
+		}
+		path.reached = r.Reached
+	}
+	return path
+}
+
+// learn keeps the routers of old as alternates of the same hops.
+func (p *routePath) learn(old *routePath) {
+	for ttl, hosts := range old.hops {
+		if ttl > p.length {
+			continue
+		}
+		for _, h := range hosts {
+			if !intersect(p.hops[ttl], []string{h}) {
+				p.hops[ttl] = append(p.hops[ttl], h)
+			}
+		}
+	}
+}
+
+func intersect(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c RouteChange) String() string {
+	switch c.Type {
+	case RouteLengthChanged:
+		return fmt.Sprintf("%v %v->%v length %v -> %v", c.Type, c.SrcAddr, c.DstAddr, c.OldLen, c.NewLen)
+	case RouteUnreachable:
+		return fmt.Sprintf("%v %v->%v", c.Type, c.SrcAddr, c.DstAddr)
+	}
+	return fmt.Sprintf("%v %v->%v ttl %v [%v] -> [%v]", c.Type, c.SrcAddr, c.DstAddr, c.TTL,
+		strings.Join(c.Old, " "), strings.Join(c.New, " "))
+}
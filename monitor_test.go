@@ -0,0 +1,60 @@
+package go_mtr
+
+import (
+	"testing"
+	"time"
+)
+
+func routeResult(reached bool, hosts ...string) TraceResult {
+	res := TraceResult{Trace: Trace{SrcAddr: "10.0.0.1", DstAddr: "10.0.0.9", Protocol: ProtoICMP}}
+	for idx, h := range hosts {
+		r := TraceRes{TTL: uint8(idx + 1), SrcTTL: h, Latency: time.Millisecond}
+		if h == "" {
+			r.Latency, r.PacketLoss = 0, 1
+		}
+		res.Res = append(res.Res, r)
+	}
+	if reached {
+		res.Res[len(res.Res)-1].Reached = true
+	}
+	return res
+}
+
+func TestRouteMonitor(t *testing.T) {
+	m := NewRouteMonitor(RouteMonitorConfig{Similarity: 0.7})
+	if c := m.Observe(routeResult(true, "a", "b", "c", "d", "10.0.0.9")); c != nil {
+		t.Fatalf("first result reported %v", c)
+	}
+	// one hop out of five flapping is tolerated, so is a silent hop.
+	if c := m.Observe(routeResult(true, "a", "x", "", "d", "10.0.0.9")); c != nil {
+		t.Fatalf("ecmp reported %v", c)
+	}
+	// x is now a known alternate of ttl 2.
+	if c := m.Observe(routeResult(true, "a", "x", "y", "d", "10.0.0.9")); c != nil {
+		t.Fatalf("ecmp reported %v", c)
+	}
+	c := m.Observe(routeResult(true, "a", "e", "f", "10.0.0.9"))
+	if len(c) != 5 || c[0].Type != RouteHopReplaced || c[0].TTL != 2 || c[2].Type != RouteHopReplaced ||
+		c[2].TTL != 4 || c[3].Type != RouteHopRemoved || c[3].TTL != 5 ||
+		c[4].Type != RouteLengthChanged || c[4].OldLen != 5 || c[4].NewLen != 4 {
+		t.Fatalf("unexpected changes %v", c)
+	}
+	c = m.Observe(routeResult(false, "a", "e", "", ""))
+	if len(c) != 4 || c[0].Type != RouteHopRemoved || c[0].TTL != 3 || c[2].Type != RouteLengthChanged ||
+		c[3].Type != RouteUnreachable {
+		t.Fatalf("unexpected changes %v", c)
+	}
+	failed := routeResult(false)
+	failed.Err = errIdExhausted
+	if c := m.Observe(failed); c != nil {
+		t.Fatalf("failed trace reported %v", c)
+	}
+	if c := m.Observe(routeResult(false, "a", "e", "", "")); c != nil {
+		t.Fatalf("failed trace kept as the known path %v", c)
+	}
+	other := routeResult(true, "a")
+	other.Protocol = ProtoUDP
+	if c := m.Observe(other); c != nil {
+		t.Fatalf("protocols share a path %v", c)
+	}
+}
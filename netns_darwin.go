@@ -0,0 +1,15 @@
+package go_mtr
+
+import (
+	"errors"
+)
+
+var errNetnsUnsupported = errors.New("network namespaces are linux only")
+
+// withNetns runs fn, network namespaces exist on linux only.
+func withNetns(netns string, fn func() error) error {
+	if netns != "" {
+		return errNetnsUnsupported
+	}
+	return fn()
+}
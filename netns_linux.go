@@ -0,0 +1,54 @@
+package go_mtr
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// withNetns runs fn inside the network namespace netns, a path like
+// /var/run/netns/blue. Sockets fn opens stay in netns, the rest of the
+// program is left in its own. Empty netns runs fn as is.
+func withNetns(netns string, fn func() error) error {
+	if netns == "" {
+		return fn()
+	}
+	errCh := make(chan error, 1)
+	// setns switches the calling thread only, so fn runs on a thread of its
+	// own no other goroutine is scheduled on meanwhile.
+	go func() {
+		runtime.LockOSThread()
+		host, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- err
+			return
+		}
+		defer host.Close()
+		ns, err := os.Open(netns)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- err
+			return
+		}
+		defer ns.Close()
+		err = unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("enter netns (%v) error (%v)", netns, err)
+			return
+		}
+		fnErr := fn()
+		err = unix.Setns(int(host.Fd()), unix.CLONE_NEWNET)
+		if err != nil {
+			// the thread is left locked, go terminates it with the goroutine.
+			errCh <- fmt.Errorf("leave netns (%v) error (%v)", netns, err)
+			return
+		}
+		runtime.UnlockOSThread()
+		errCh <- fnErr
+	}()
+	return <-errCh
+}
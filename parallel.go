@@ -0,0 +1,141 @@
+package go_mtr
+
+import (
+	"sort"
+	"time"
+)
+
+// traceParallel keeps up to Config.TTLWindow probes in flight across the ttl
+// range instead of waiting for every hop in turn. Sending stops at the ttl the
+// destination answered on, or after MaxUnReply consecutive silent hops, and
+// probes beyond that point are dropped from the result.
+func (t *tracer) traceParallel(run *traceRun, startTTL uint8) {
+	tc := run.tc
+	limit := int(tc.MaxTTL)
+	inflight := map[uint16]*probeState{}
+	sent := map[int]int{}
+	done := map[int]int{}
+	replied := map[int]bool{}
+	nextTTL, nextRetry := int(startTTL), 0
+	hopTTL := int(startTTL)
+	unReply := 0
+	timer := time.NewTimer(tc.NextHopWait)
+	defer timer.Stop()
+	// cut stops probing beyond ttl, probes still in flight there are not
+	// counted as sent. Those already answered or timed out are taken back
+	// once probing is over, as late replies may still change them.
+	cut := func(ttl int) {
+		if ttl >= limit {
+			return
+		}
+		limit = ttl
+		for seq, p := range inflight {
+			if int(p.ttl) > limit {
+				delete(inflight, seq)
+				run.total--
+			}
+		}
+	}
+	for {
+		for len(inflight) < t.conf.TTLWindow && nextTTL <= limit && run.ctx.Err() == nil {
+			run.total++
+			run.seq = nextSeq(run.seq)
+			sent[nextTTL]++
+			probe, err := t.sendProbe(run.ctx, tc, uint8(nextTTL), run.seq)
+			if err != nil {
+				if run.ctx.Err() != nil {
+					run.total--
+				} else {
+					run.sendFailed(uint8(nextTTL), err)
+				}
+				done[nextTTL]++
+			} else {
+				inflight[probe.seq] = probe
+				run.probeSent(probe)
+			}
+			nextRetry++
+			if nextRetry >= tc.Retry {
+				nextRetry = 0
+				nextTTL++
+			}
+		}
+		for hopTTL <= limit && sent[hopTTL] == tc.Retry && done[hopTTL] == tc.Retry {
+			run.hopDone(uint8(hopTTL))
+			if replied[hopTTL] {
+				unReply = 0
+			} else {
+				unReply++
+			}
+			if unReply >= tc.MaxUnReply {
+				cut(hopTTL)
+			}
+			hopTTL++
+		}
+		if len(inflight) == 0 && (nextTTL > limit || run.ctx.Err() != nil) {
+			break
+		}
+		var earliest time.Time
+		for _, p := range inflight {
+			if earliest.IsZero() || p.expire.Before(earliest) {
+				earliest = p.expire
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(earliest))
+		select {
+		case <-run.ctx.Done():
+			run.total -= len(inflight)
+			inflight = map[uint16]*probeState{}
+		case now := <-timer.C:
+			for seq, p := range inflight {
+				if !p.expire.After(now) {
+					delete(inflight, seq)
+					done[int(p.ttl)]++
+					run.timeout(p)
+				}
+			}
+		case rp := <-run.replies:
+			if inflight[rp.probe.seq] != rp.probe {
+				run.lateReply(rp)
+				ttl := int(rp.probe.ttl)
+				replied[ttl] = true
+				if ttl < hopTTL && ttl >= hopTTL-unReply {
+					// the hop was reported silent, the silent ones are
+					// those after it only.
+					unReply = hopTTL - 1 - ttl
+				}
+			} else {
+				delete(inflight, rp.probe.seq)
+				done[int(rp.probe.ttl)]++
+				replied[int(rp.probe.ttl)] = true
+				run.reply(rp)
+			}
+			if rp.reached() {
+				cut(int(rp.probe.ttl))
+			}
+		}
+	}
+	if run.ctx.Err() != nil {
+		tc.Cancelled = true
+	}
+	sort.SliceStable(tc.Res, func(i, j int) bool {
+		return tc.Res[i].TTL < tc.Res[j].TTL
+	})
+	res := tc.Res[:0]
+	for _, r := range tc.Res {
+		if int(r.TTL) <= limit {
+			res = append(res, r)
+			continue
+		}
+		run.total--
+		if r.PacketLoss == 1 {
+			run.loss--
+		}
+	}
+	tc.Res = res
+}
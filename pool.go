@@ -0,0 +1,138 @@
+package go_mtr
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// tracePool bounds the traces probing at the same time across every batch of
+// a tracer. Traces waiting for a slot are admitted by priority, then in the
+// order they were queued.
+type tracePool struct {
+	lock    sync.Mutex
+	max     int
+	running int
+	waiting int
+	seq     uint64
+	queue   poolQueue
+}
+
+type poolTask struct {
+	priority int
+	seq      uint64
+	index    int
+	ready    chan struct{}
+}
+
+type poolQueue []*poolTask
+
+func newTracePool(max int) *tracePool {
+	return &tracePool{max: max}
+}
+
+// enqueue accounts n traces waiting for admission, each of them must then
+// either acquire a slot or be dropped.
+func (p *tracePool) enqueue(n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.waiting += n
+}
+
+func (p *tracePool) drop(n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.waiting -= n
+}
+
+func (p *tracePool) acquire(ctx context.Context, priority int) error {
+	p.lock.Lock()
+	if ctx.Err() != nil {
+		p.lock.Unlock()
+		return ctx.Err()
+	}
+	if p.max <= 0 || p.running < p.max {
+		p.running++
+		p.waiting--
+		p.lock.Unlock()
+		return nil
+	}
+	p.seq++
+	task := &poolTask{
+		priority: priority,
+		seq:      p.seq,
+		ready:    make(chan struct{}),
+	}
+	heap.Push(&p.queue, task)
+	p.lock.Unlock()
+	select {
+	case <-task.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	select {
+	case <-task.ready:
+		// admitted while giving up, hand the slot on and count the task
+		// as waiting again, the caller drops it like the others.
+		p.waiting++
+		p.next()
+	default:
+		heap.Remove(&p.queue, task.index)
+	}
+	return ctx.Err()
+}
+
+func (p *tracePool) release() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.next()
+}
+
+// next gives the slot of a finished trace to the first one queued.
+func (p *tracePool) next() {
+	if p.queue.Len() == 0 {
+		p.running--
+		return
+	}
+	task := heap.Pop(&p.queue).(*poolTask)
+	p.waiting--
+	close(task.ready)
+}
+
+func (p *tracePool) stats() (running, waiting int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.running, p.waiting
+}
+
+func (q poolQueue) Len() int {
+	return len(q)
+}
+
+func (q poolQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q poolQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *poolQueue) Push(x interface{}) {
+	task := x.(*poolTask)
+	task.index = len(*q)
+	*q = append(*q, task)
+}
+
+func (q *poolQueue) Pop() interface{} {
+	old := *q
+	task := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return task
+}
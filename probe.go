@@ -1,6 +1,7 @@
 package go_mtr
 
 import (
+	"fmt"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -35,6 +36,28 @@ type SendProbe struct {
 	Trace
 	WriteTimeout time.Duration
 	Msg          []byte
+	// sock is kept open for the netns or interface of the trace, without it
+	// a socket is opened for the probe.
+	sock *sendSocket
+}
+
+// sendSocket is a raw socket probes are sent from one after the other.
+type sendSocket struct {
+	fd int
+}
+
+func (s *sendSocket) Close() {
+	unix.Close(s.fd)
+}
+
+// sendSocketError tells the socket probes are sent from could not be opened
+// or set up, so no probe of the trace can be sent.
+type sendSocketError struct {
+	err error
+}
+
+func (e *sendSocketError) Error() string {
+	return fmt.Sprintf("open send socket error (%v)", e.err)
 }
 
 func newProbeIpv4() Detector {
@@ -51,18 +74,15 @@ func (p *probeIpv4) Probe(req SendProbe) error {
 }
 
 func (p *probeIpv4) probe(req SendProbe) error {
-	var fd int
-	var err error
-	_ = unix.AF_INET
-	fd, err = unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
-	if err != nil {
-		return err
+	if req.sock != nil {
+		// the ip header carries the source, no need to bind.
+		return unix.Sendto(req.sock.fd, req.Msg, 0, req.DstSockAddr)
 	}
-	defer unix.Close(fd)
-	err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_HDRINCL, 1)
+	fd, err := openSendSocket(req.Netns, req.Interface, req.Mark)
 	if err != nil {
 		return err
 	}
+	defer unix.Close(fd)
 	err = unix.Bind(fd, req.SrcSockAddr)
 	if err != nil {
 		return err
@@ -70,3 +90,29 @@ func (p *probeIpv4) probe(req SendProbe) error {
 	err = unix.Sendto(fd, req.Msg, 0, req.DstSockAddr)
 	return err
 }
+
+// openSendSocket opens a raw socket in netns, bound to iface and marking its
+// packets with mark unless unset.
+func openSendSocket(netns string, iface string, mark uint32) (int, error) {
+	var fd int
+	err := withNetns(netns, func() error {
+		var err error
+		fd, err = unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+		return err
+	})
+	if err != nil {
+		return 0, &sendSocketError{err: err}
+	}
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_HDRINCL, 1)
+	if err == nil && iface != "" {
+		err = setSockOptBindToDevice(fd, iface)
+	}
+	if err == nil && mark != 0 {
+		err = setSockOptMark(fd, mark)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return 0, &sendSocketError{err: err}
+	}
+	return fd, nil
+}
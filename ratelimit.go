@@ -0,0 +1,237 @@
+package go_mtr
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces out probes before they are sent, so a probe waiting here
+// has not started its NextHopWait yet.
+type rateLimiter struct {
+	bucket    *tokenBucket
+	prefix    *pacer
+	prefixLen int
+	hop       *pacer
+	// router which answered for a destination and ttl, used to pace probes
+	// expected to expire on the same router. The maxRouters which answered
+	// last are kept, routersAge orders them from the most recent.
+	routersLock sync.Mutex
+	routers     map[string]*list.Element
+	routersAge  *list.List
+}
+
+type learnedRouter struct {
+	key    string
+	router string
+}
+
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+type pacer struct {
+	lock sync.Mutex
+	gap  time.Duration
+	next map[string]time.Time
+}
+
+const (
+	maxPacerKeys = 4096
+	maxRouters   = 1 << 16
+)
+
+func newRateLimiter(conf Config) *rateLimiter {
+	l := &rateLimiter{
+		routers:    map[string]*list.Element{},
+		routersAge: list.New(),
+	}
+	if conf.ProbeRate > 0 {
+		burst := float64(conf.ProbeBurst)
+		if burst < 1 {
+			burst = 1
+		}
+		l.bucket = &tokenBucket{
+			rate:   conf.ProbeRate,
+			burst:  burst,
+			tokens: burst,
+			last:   time.Now(),
+		}
+	}
+	if conf.PrefixPacing > 0 {
+		l.prefix = newPacer(conf.PrefixPacing)
+		l.prefixLen = conf.PrefixLen
+	}
+	if conf.HopPacing > 0 {
+		l.hop = newPacer(conf.HopPacing)
+	}
+	return l
+}
+
+func newPacer(gap time.Duration) *pacer {
+	return &pacer{
+		gap:  gap,
+		next: map[string]time.Time{},
+	}
+}
+
+// wait blocks until a probe to dst with ttl may be sent. The token and slots
+// it reserved are given back when ctx is done first.
+func (l *rateLimiter) wait(ctx context.Context, dst string, ttl uint8) error {
+	now := time.Now()
+	at := now
+	var prefixKey, router string
+	var prefixAt, routerAt time.Time
+	if l.prefix != nil {
+		prefixKey = l.prefixKey(dst)
+		prefixAt = l.prefix.reserve(prefixKey, now)
+		at = latest(at, prefixAt)
+	}
+	if l.hop != nil {
+		router = l.router(dst, ttl)
+		if router != "" {
+			routerAt = l.hop.reserve(router, now)
+			at = latest(at, routerAt)
+		}
+	}
+	if l.bucket != nil {
+		at = latest(at, l.bucket.reserve(now))
+	}
+	if !at.After(now) {
+		return nil
+	}
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		if l.prefix != nil {
+			l.prefix.cancel(prefixKey, prefixAt)
+		}
+		if router != "" {
+			l.hop.cancel(router, routerAt)
+		}
+		if l.bucket != nil {
+			l.bucket.cancel()
+		}
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (l *rateLimiter) router(dst string, ttl uint8) string {
+	l.routersLock.Lock()
+	defer l.routersLock.Unlock()
+	e, ok := l.routers[routerKey(dst, ttl)]
+	if !ok {
+		return ""
+	}
+	return e.Value.(*learnedRouter).router
+}
+
+func (l *rateLimiter) learn(dst string, ttl uint8, router string) {
+	if l.hop == nil || router == "" {
+		return
+	}
+	key := routerKey(dst, ttl)
+	l.routersLock.Lock()
+	defer l.routersLock.Unlock()
+	if e, ok := l.routers[key]; ok {
+		e.Value.(*learnedRouter).router = router
+		l.routersAge.MoveToFront(e)
+		return
+	}
+	l.routers[key] = l.routersAge.PushFront(&learnedRouter{key: key, router: router})
+	if l.routersAge.Len() > maxRouters {
+		oldest := l.routersAge.Back()
+		l.routersAge.Remove(oldest)
+		delete(l.routers, oldest.Value.(*learnedRouter).key)
+	}
+}
+
+func routerKey(dst string, ttl uint8) string {
+	return fmt.Sprintf("%v-%v", dst, ttl)
+}
+
+func (l *rateLimiter) prefixKey(dst string) string {
+	ip := net.ParseIP(dst)
+	if ip == nil {
+		return dst
+	}
+	bits := l.prefixLen
+	if ip4 := ip.To4(); ip4 != nil {
+		if bits <= 0 || bits > 32 {
+			bits = 24
+		}
+		return ip4.Mask(net.CIDRMask(bits, 32)).String()
+	}
+	if bits <= 0 || bits > 128 {
+		bits = 48
+	}
+	return ip.Mask(net.CIDRMask(bits, 128)).String()
+}
+
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// reserve takes a token and returns when it is available, tokens taken in
+// advance queue up behind each other.
+func (b *tokenBucket) reserve(now time.Time) time.Time {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		b.last = now
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.tokens--
+	if b.tokens >= 0 {
+		return now
+	}
+	return now.Add(time.Duration(-b.tokens / b.rate * float64(time.Second)))
+}
+
+// cancel gives back a token reserved but not used.
+func (b *tokenBucket) cancel() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens++
+}
+
+// reserve books the next slot for key, at least gap after the previous one.
+func (p *pacer) reserve(key string, now time.Time) time.Time {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.next) > maxPacerKeys {
+		for k, at := range p.next {
+			if at.Before(now) {
+				delete(p.next, k)
+			}
+		}
+	}
+	at := latest(now, p.next[key])
+	p.next[key] = at.Add(p.gap)
+	return at
+}
+
+// cancel frees the slot at of key unless a later one was booked behind it.
+func (p *pacer) cancel(key string, at time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.next[key].Equal(at.Add(p.gap)) {
+		p.next[key] = at
+	}
+}
@@ -0,0 +1,83 @@
+package go_mtr
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(Config{ProbeRate: 100, ProbeBurst: 2})
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := l.wait(context.Background(), "10.0.0.1", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// two probes of burst then 4 at 10ms each
+	if d := time.Since(start); d < time.Millisecond*35 || d > time.Millisecond*200 {
+		t.Fatalf("unexpected rate, 6 probes took %v", d)
+	}
+
+	l = newRateLimiter(Config{PrefixPacing: time.Millisecond * 30, HopPacing: time.Millisecond * 30})
+	start = time.Now()
+	l.wait(context.Background(), "10.0.0.1", 1)
+	l.wait(context.Background(), "10.0.1.1", 1)
+	if time.Since(start) > time.Millisecond*20 {
+		t.Fatalf("different prefixes should not be paced")
+	}
+	l.wait(context.Background(), "10.0.0.2", 1)
+	if time.Since(start) < time.Millisecond*30 {
+		t.Fatalf("same prefix not paced")
+	}
+	l.learn("10.0.2.1", 3, "192.168.0.1")
+	l.learn("10.0.3.1", 5, "192.168.0.1")
+	start = time.Now()
+	l.wait(context.Background(), "10.0.2.1", 3)
+	l.wait(context.Background(), "10.0.3.1", 5)
+	if time.Since(start) < time.Millisecond*30 {
+		t.Fatalf("same router not paced")
+	}
+
+	l = newRateLimiter(Config{ProbeRate: 1})
+	l.wait(context.Background(), "10.0.0.1", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := l.wait(ctx, "10.0.0.1", 1); err == nil {
+		t.Fatalf("wait not cancelled")
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := newRateLimiter(Config{ProbeRate: 20, PrefixPacing: time.Millisecond * 50})
+	l.wait(context.Background(), "10.0.0.1", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*5)
+	defer cancel()
+	if err := l.wait(ctx, "10.0.0.2", 1); err == nil {
+		t.Fatalf("wait not cancelled")
+	}
+	// the cancelled probe gave its token and slot back.
+	start := time.Now()
+	l.wait(context.Background(), "10.0.0.3", 1)
+	if d := time.Since(start); d > time.Millisecond*75 {
+		t.Fatalf("cancelled reservation kept, wait took %v", d)
+	}
+}
+
+func TestRateLimiterRoutersBound(t *testing.T) {
+	l := newRateLimiter(Config{HopPacing: time.Millisecond})
+	for i := 0; i < maxRouters+10; i++ {
+		l.learn(fmt.Sprintf("10.%v.%v.%v", i>>16, i>>8&0xff, i&0xff), 1, "192.168.0.1")
+		if i == 20 {
+			// answering again keeps the router.
+			l.learn("10.0.0.0", 1, "192.168.0.2")
+		}
+	}
+	if len(l.routers) != maxRouters || l.routersAge.Len() != maxRouters {
+		t.Fatalf("%v routers kept", len(l.routers))
+	}
+	if l.router("10.0.0.1", 1) != "" || l.router("10.0.0.0", 1) != "192.168.0.2" || l.router("10.1.0.9", 1) == "" {
+		t.Fatalf("not the oldest routers forgotten")
+	}
+}
@@ -0,0 +1,59 @@
+package go_mtr
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	reverseDNSTimeout = 2 * time.Second
+	reverseDNSRate    = 20
+	reverseDNSTTL     = time.Hour
+)
+
+// PTRResolver looks up the names of an address, *net.Resolver satisfies it.
+type PTRResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// newReverseDNS is the cache of hop names, nil when conf does not want them.
+func newReverseDNS(conf Config) *lookupCache {
+	if !conf.ReverseDNS {
+		return nil
+	}
+	var resolver PTRResolver = net.DefaultResolver
+	if conf.PTRResolver != nil {
+		resolver = conf.PTRResolver
+	}
+	timeout := conf.ReverseDNSTimeout
+	if timeout <= 0 {
+		timeout = reverseDNSTimeout
+	}
+	rate := conf.ReverseDNSRate
+	if rate <= 0 {
+		rate = reverseDNSRate
+	}
+	return newLookupCache(func(ctx context.Context, ip string) (interface{}, error) {
+		names, err := resolver.LookupAddr(ctx, ip)
+		if err != nil || len(names) == 0 {
+			return "", err
+		}
+		return strings.TrimSuffix(names[0], "."), nil
+	}, timeout, rate, reverseDNSTTL)
+}
+
+// hostname is the name of ip when its lookup is over, it is started otherwise.
+func (c *lookupCache) hostname(ip string) string {
+	name, _ := c.peek(ip)
+	s, _ := name.(string)
+	return s
+}
+
+func hopName(ip, hostname string) string {
+	if hostname == "" || hostname == ip {
+		return ip
+	}
+	return hostname + " (" + ip + ")"
+}
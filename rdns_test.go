@@ -0,0 +1,125 @@
+package go_mtr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubPTR names 10.0.x.1 routers hop-x and counts the lookups of every address.
+type stubPTR struct {
+	lock    sync.Mutex
+	lookups map[string]int
+	delay   time.Duration
+}
+
+func (s *stubPTR) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	s.lock.Lock()
+	s.lookups[addr]++
+	s.lock.Unlock()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.delay):
+	}
+	parts := strings.Split(addr, ".")
+	return []string{"hop-" + parts[2] + ".example.com."}, nil
+}
+
+func TestReverseDNS(t *testing.T) {
+	ptr := &stubPTR{lookups: map[string]int{}}
+	net := &fakeNet{hops: 3}
+	tr := newFakeTracer(Config{
+		ICMP:        true,
+		MaxUnReply:  3,
+		NextHopWait: time.Millisecond * 50,
+		ReverseDNS:  true,
+		PTRResolver: ptr,
+	}, net)
+	tc := fakeTrace(t)
+	tc.Retry = 2
+	for i := 0; i < 2; i++ {
+		res := tr.BatchTrace([]Trace{tc}, 1)[0]
+		if res.Res[0].Hostname != "hop-1.example.com" || res.Res[3].Hostname != "hop-2.example.com" {
+			t.Fatalf("hops not named\n%v", res.Marshal())
+		}
+		if agg := res.Aggregate(); agg.Res[1].Hostname != "hop-2.example.com" ||
+			!strings.Contains(agg.MarshalHop(agg.Res[1]), "hop-2.example.com (10.0.2.1)") {
+			t.Fatalf("aggregated hops not named\n%v", agg.Marshal())
+		}
+	}
+	for addr, n := range ptr.lookups {
+		if n != 1 {
+			t.Fatalf("%v looked up %v times", addr, n)
+		}
+	}
+}
+
+func TestReverseDNSTimeout(t *testing.T) {
+	ptr := &stubPTR{lookups: map[string]int{}, delay: time.Second}
+	net := &fakeNet{hops: 3}
+	tr := newFakeTracer(Config{
+		ICMP:              true,
+		MaxUnReply:        3,
+		NextHopWait:       time.Millisecond * 50,
+		ReverseDNS:        true,
+		ReverseDNSTimeout: time.Millisecond * 20,
+		PTRResolver:       ptr,
+	}, net)
+	start := time.Now()
+	res := tr.BatchTrace([]Trace{fakeTrace(t)}, 1)[0]
+	if time.Since(start) > time.Millisecond*500 || res.Res[0].Hostname != "" || !res.Done {
+		t.Fatalf("slow names held the trace %v\n%v", time.Since(start), res.Marshal())
+	}
+}
+
+func TestLookupWorkers(t *testing.T) {
+	var lock sync.Mutex
+	running, most := 0, 0
+	c := newLookupCache(func(ctx context.Context, ip string) (interface{}, error) {
+		lock.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		lock.Unlock()
+		time.Sleep(time.Millisecond * 5)
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return ip, nil
+	}, time.Second, 0, time.Minute)
+	var ips []string
+	for i := 0; i < lookupWorkers*5; i++ {
+		ip := fmt.Sprintf("10.0.0.%v", i)
+		ips = append(ips, ip)
+		c.start(ip)
+	}
+	c.wait(ips, time.Now())
+	for _, ip := range ips {
+		if v, ok := c.peek(ip); !ok || v != ip {
+			t.Fatalf("%v not looked up", ip)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if most > lookupWorkers {
+		t.Fatalf("%v lookups ran at once", most)
+	}
+	// the workers exit right after their last lookup.
+	for i := 0; ; i++ {
+		c.lock.Lock()
+		workers := c.workers
+		c.lock.Unlock()
+		if workers == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("%v workers left without queued lookups", workers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
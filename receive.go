@@ -35,13 +35,34 @@ type rcvIpv4 struct {
 }
 
 func newRcvIpv4() (Receiver, error) {
+	return newRcvIpv4Proto(unix.IPPROTO_ICMP, "", "")
+}
+
+// newRcvIpv4TCP receives the tcp segments targets answer tcp probes with.
+func newRcvIpv4TCP() (Receiver, error) {
+	return newRcvIpv4Proto(unix.IPPROTO_TCP, "", "")
+}
+
+// newRcvIpv4Proto receives the packets of proto in the network namespace
+// netns, those arriving through iface only unless empty.
+func newRcvIpv4Proto(proto int, netns string, iface string) (Receiver, error) {
 	var err error
 	var fd int
-	fd, err = unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_ICMP)
+	err = withNetns(netns, func() error {
+		fd, err = unix.Socket(unix.AF_INET, unix.SOCK_RAW, proto)
+		return err
+	})
 	if err != nil {
 
 		return nil, err
 	}
+	if iface != "" {
+		err = setSockOptBindToDevice(fd, iface)
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
 	err = setSockOptReceiveErr(fd)
 	if err != nil {
 		return nil, err
@@ -60,6 +81,8 @@ func newRcvIpv4() (Receiver, error) {
 	return rc, err
 }
 
+// Receive hands out the packets of the socket until Close, the channel is
+// then closed so its readers end too.
 func (r *rcvIpv4) Receive() chan []byte {
 	ch := make(chan []byte, 100000)
 	go func() {
@@ -67,15 +90,16 @@ func (r *rcvIpv4) Receive() chan []byte {
 			select {
 			case <-r.ctx.Done():
 				unix.Close(r.fd)
+				close(ch)
 				return
 			default:
 			}
 			bts := make([]byte, 512)
-			_, _, err := unix.Recvfrom(r.fd, bts, 0)
+			n, _, err := unix.Recvfrom(r.fd, bts, 0)
 			if err != nil {
 				continue
 			}
-			ch <- bts
+			ch <- bts[:n]
 		}
 	}()
 	return ch
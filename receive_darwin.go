@@ -1,14 +1,32 @@
 package go_mtr
 
 import (
-	"golang.org/x/sys/unix"
+	"errors"
+	"net"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func setSockOptReceiveErr(fd int) error {
 	return nil
 }
 
+// setSockOptBindToDevice keeps the socket to iface with IP_BOUND_IF.
+func setSockOptBindToDevice(fd int, iface string) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_BOUND_IF, ifi.Index)
+}
+
+var errMarkUnsupported = errors.New("fwmark is linux only")
+
+func setSockOptMark(fd int, mark uint32) error {
+	return errMarkUnsupported
+}
+
 func setSockOptRcvTimeout(fd int, timeout time.Duration) error {
 	tv := unix.NsecToTimeval(timeout.Nanoseconds())
 	err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
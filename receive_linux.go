@@ -10,6 +10,18 @@ func setSockOptReceiveErr(fd int) error {
 	return err
 }
 
+// setSockOptBindToDevice keeps the socket to iface, a vrf device binds it to
+// the vrf.
+func setSockOptBindToDevice(fd int, iface string) error {
+	return unix.BindToDevice(fd, iface)
+}
+
+// setSockOptMark sets the fwmark of the packets sent from the socket, which
+// ip rules and netfilter match on.
+func setSockOptMark(fd int, mark uint32) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+}
+
 func setSockOptRcvTimeout(fd int, timeout time.Duration) error {
 	tv := unix.NsecToTimeval(timeout.Nanoseconds())
 	err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
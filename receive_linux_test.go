@@ -0,0 +1,103 @@
+package go_mtr
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkBound reads SO_BINDTODEVICE and SO_MARK of fd back.
+func checkBound(t *testing.T, fd int, iface string, mark uint32) {
+	dev, err := unix.GetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	if err != nil || dev != iface {
+		t.Fatalf("socket bound to (%v) not (%v) error (%v)", dev, iface, err)
+	}
+	got, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK)
+	if err != nil || uint32(got) != mark {
+		t.Fatalf("socket marked (%v) not (%v) error (%v)", got, mark, err)
+	}
+}
+
+func TestBoundSockets(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("raw sockets need root")
+	}
+	fd, err := openSendSocket("", "lo", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBound(t, fd, "lo", 7)
+	unix.Close(fd)
+	rc, err := newRcvIpv4Proto(unix.IPPROTO_ICMP, "", "lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBound(t, rc.(*rcvIpv4).fd, "lo", 0)
+	unix.Close(rc.(*rcvIpv4).fd)
+}
+
+func TestWithNetns(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces need root")
+	}
+	// a thread in a fresh netns, which only has lo, until the test ends.
+	nsPath := make(chan string)
+	done, left := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(done)
+		<-left
+	}()
+	go func() {
+		defer close(left)
+		runtime.LockOSThread()
+		host, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			close(nsPath)
+			return
+		}
+		defer host.Close()
+		err = unix.Unshare(unix.CLONE_NEWNET)
+		if err != nil {
+			runtime.UnlockOSThread()
+			close(nsPath)
+			return
+		}
+		nsPath <- fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+		<-done
+		// go keeps the main thread when its goroutine exits locked, it must
+		// not stay in the netns.
+		if unix.Setns(int(host.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+	netns, ok := <-nsPath
+	if !ok {
+		t.Skip("cannot create a network namespace")
+	}
+	host, _ := net.Interfaces()
+	var names []string
+	err := withNetns(netns, func() error {
+		ifaces, err := net.Interfaces()
+		for _, iface := range ifaces {
+			names = append(names, iface.Name)
+		}
+		return err
+	})
+	if err != nil || len(names) != 1 || names[0] != "lo" {
+		t.Fatalf("interfaces of the netns %v error (%v)", names, err)
+	}
+	fd, err := openSendSocket(netns, "lo", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBound(t, fd, "lo", 7)
+	unix.Close(fd)
+	if ifaces, _ := net.Interfaces(); len(ifaces) != len(host) {
+		t.Fatalf("program left outside its netns, %v interfaces of %v", len(ifaces), len(host))
+	}
+}
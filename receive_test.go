@@ -1,8 +1,12 @@
 package go_mtr
 
 import (
+	"context"
 	"fmt"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func fmtICMPRcv(r *ICMPRcv) {
@@ -27,3 +31,35 @@ func TestReceive(t *testing.T) {
 		}
 	}
 }
+
+func TestReceiveClose(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	err = setSockOptRcvTimeout(fds[0], time.Millisecond*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rcv := &rcvIpv4{fd: fds[0], ctx: ctx, cancel: cancel}
+	ch := rcv.Receive()
+	unix.Write(fds[1], []byte{1, 2, 3})
+	if msg := <-ch; len(msg) != 3 || msg[0] != 1 {
+		t.Fatalf("unexpected packet %v", msg)
+	}
+	rcv.Close()
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timer.C:
+			t.Fatalf("channel of a closed receiver left open")
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package go_mtr
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TracerStats counts replies which could not be attributed to a probe in
+// flight, and the traces admitted by the tracer.
+type TracerStats struct {
+	// Unmatched replies quote a packet we have no record of, or one whose
+	// destination, protocol or ttl disagrees with what was sent.
+	Unmatched uint64
+	// Late replies belong to a probe whose wait time had already elapsed.
+	Late uint64
+	// Running traces are probing, QueueDepth traces wait for one of them to
+	// finish when Config.MaxConcurrentTraces is reached.
+	Running    int
+	QueueDepth int
+}
+
+type probeState struct {
+	proto  uint8
+	dst    string
+	ttl    uint8
+	seq    uint16
+	sentAt time.Time
+	expire time.Time
+}
+
+type probeRegistry struct {
+	lock      sync.Mutex
+	probes    map[string]map[uint16]*probeState
+	unmatched uint64
+	late      uint64
+}
+
+var (
+	errProbeUnmatched = fmt.Errorf("reply does not match any probe in flight")
+	errProbeLate      = fmt.Errorf("reply arrived after probe timeout")
+)
+
+func newProbeRegistry() *probeRegistry {
+	return &probeRegistry{
+		probes: map[string]map[uint16]*probeState{},
+	}
+}
+
+func (r *probeRegistry) register(key string, p *probeState) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	m, ok := r.probes[key]
+	if !ok {
+		m = map[uint16]*probeState{}
+		r.probes[key] = m
+	}
+	m[p.seq] = p
+}
+
+func (r *probeRegistry) release(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.probes, key)
+}
+
+// match validates a reply against the probes sent under key and removes the
+// matched probe, so that a duplicated reply is never counted twice.
+func (r *probeRegistry) match(key string, rcv *ICMPRcv) (*probeState, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	m := r.probes[key]
+	p := m[rcv.Seq]
+	if p == nil || !p.validate(rcv) {
+		atomic.AddUint64(&r.unmatched, 1)
+		return nil, errProbeUnmatched
+	}
+	delete(m, p.seq)
+	if rcv.RcvAt.After(p.expire) {
+		atomic.AddUint64(&r.late, 1)
+		return p, errProbeLate
+	}
+	return p, nil
+}
+
+func (r *probeRegistry) countUnmatched() {
+	atomic.AddUint64(&r.unmatched, 1)
+}
+
+func (r *probeRegistry) stats() TracerStats {
+	return TracerStats{
+		Unmatched: atomic.LoadUint64(&r.unmatched),
+		Late:      atomic.LoadUint64(&r.late),
+	}
+}
+
+func (p *probeState) validate(rcv *ICMPRcv) bool {
+	if rcv.Proto != p.proto || rcv.Dst != p.dst {
+		return false
+	}
+	if rcv.RcvAt.Before(p.sentAt) {
+		return false
+	}
+	// routers quote the remaining ttl, which can never exceed what we sent.
+	if rcv.RcvType == ICMPTimeExceed && rcv.TTL > p.ttl {
+		return false
+	}
+	return true
+}
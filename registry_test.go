@@ -0,0 +1,46 @@
+package go_mtr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegistryMatch(t *testing.T) {
+	reg := newProbeRegistry()
+	now := time.Now()
+	reg.register("k", &probeState{
+		proto:  1,
+		dst:    "8.8.8.8",
+		ttl:    3,
+		seq:    3,
+		sentAt: now,
+		expire: now.Add(time.Second),
+	})
+	reg.register("k", &probeState{
+		proto:  1,
+		dst:    "8.8.8.8",
+		ttl:    4,
+		seq:    4,
+		sentAt: now,
+		expire: now.Add(time.Millisecond),
+	})
+	rcv := &ICMPRcv{RcvType: ICMPTimeExceed, RcvAt: now.Add(time.Millisecond * 10), Dst: "8.8.8.8", Proto: 1, Seq: 3, TTL: 1}
+	if _, err := reg.match("k", rcv); err != nil {
+		t.Fatalf("expect matched, got %v", err)
+	}
+	if _, err := reg.match("k", rcv); err != errProbeUnmatched {
+		t.Fatalf("expect duplicated reply unmatched, got %v", err)
+	}
+	rcv = &ICMPRcv{RcvType: ICMPTimeExceed, RcvAt: now.Add(time.Millisecond * 10), Dst: "1.1.1.1", Proto: 1, Seq: 4, TTL: 1}
+	if _, err := reg.match("k", rcv); err != errProbeUnmatched {
+		t.Fatalf("expect wrong destination unmatched, got %v", err)
+	}
+	rcv.Dst = "8.8.8.8"
+	if _, err := reg.match("k", rcv); err != errProbeLate {
+		t.Fatalf("expect late, got %v", err)
+	}
+	st := reg.stats()
+	if st.Unmatched != 2 || st.Late != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
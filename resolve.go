@@ -0,0 +1,62 @@
+package go_mtr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// resolveTimeout bounds the resolution of GetTrace.
+const resolveTimeout = 5 * time.Second
+
+// Resolver looks up the addresses of a host, network being "ip", "ip4" or
+// "ip6". *net.Resolver satisfies it.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+var DefaultResolver Resolver = net.DefaultResolver
+
+// resolveTrace replaces a DstAddr host name with its first address of the
+// family of the trace, its first ipv4 one when the trace has no family.
+func resolveTrace(ctx context.Context, t *Trace) error {
+	if net.ParseIP(t.DstAddr) != nil {
+		return nil
+	}
+	network := "ip"
+	switch {
+	case t.Family == FamilyIPv4 || t.Family == FamilyIPv6:
+		network = t.Family
+	case t.Family != "":
+		return fmt.Errorf("invalid family (%v) must be %v/%v", t.Family, FamilyIPv4, FamilyIPv6)
+	case net.ParseIP(t.SrcAddr) != nil && IsIpv4(t.SrcAddr):
+		network = FamilyIPv4
+	case net.ParseIP(t.SrcAddr) != nil:
+		network = FamilyIPv6
+	}
+	resolver := t.Resolver
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	ips, err := resolver.LookupIP(ctx, network, t.DstAddr)
+	if err != nil {
+		return fmt.Errorf("resolve dst addr (%v) error (%v)", t.DstAddr, err)
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("resolve dst addr (%v) no %v address", t.DstAddr, network)
+	}
+	ip := ips[0]
+	if network == "ip" {
+		// resolvers mostly sort ipv6 first, yet only ipv4 is probed for now.
+		for _, addr := range ips {
+			if addr.To4() != nil {
+				ip = addr
+				break
+			}
+		}
+	}
+	t.DstName = t.DstAddr
+	t.DstAddr = ip.String()
+	return nil
+}
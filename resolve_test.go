@@ -0,0 +1,138 @@
+package go_mtr
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// stubResolver answers every name with its addresses of the asked family.
+type stubResolver map[string][]net.IP
+
+func (s stubResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, ip := range s[host] {
+		if network == "ip" || (network == FamilyIPv4) == (ip.To4() != nil) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func TestGetTraceResolve(t *testing.T) {
+	resolver := stubResolver{"example.com": {net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}}
+	for _, c := range []struct {
+		src, family, want string
+	}{
+		{"10.0.0.1", "", "192.0.2.1"},
+		{"2001:db8::9", "", "2001:db8::1"},
+		{"10.0.0.1", FamilyIPv4, "192.0.2.1"},
+		{"2001:db8::9", FamilyIPv6, "2001:db8::1"},
+	} {
+		tc, err := GetTrace(&Trace{
+			SrcAddr:  c.src,
+			DstAddr:  "example.com",
+			Family:   c.family,
+			Resolver: resolver,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.DstAddr != c.want || tc.DstName != "example.com" || tc.IsIpv4 != IsIpv4(c.want) {
+			t.Fatalf("%+v resolved %+v", c, tc)
+		}
+	}
+	if _, err := GetTrace(&Trace{SrcAddr: "10.0.0.1", DstAddr: "missing.example.com", Resolver: resolver}); err == nil {
+		t.Fatal("unknown host resolved")
+	}
+	tc, err := GetTrace(&Trace{SrcAddr: "10.0.0.1", DstAddr: "10.0.0.9", Resolver: resolver})
+	if err != nil || tc.DstName != "" || tc.DstAddr != "10.0.0.9" {
+		t.Fatalf("address resolved %+v %v", tc, err)
+	}
+}
+
+func TestResolvePreferIPv4(t *testing.T) {
+	resolver := stubResolver{
+		"example.com":    {net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")},
+		"v6.example.com": {net.ParseIP("2001:db8::2")},
+	}
+	for host, want := range map[string]string{"example.com": "192.0.2.1", "v6.example.com": "2001:db8::2"} {
+		tc := &Trace{DstAddr: host, Resolver: resolver}
+		if err := resolveTrace(context.Background(), tc); err != nil || tc.DstAddr != want {
+			t.Fatalf("%v resolved to %v %v, want %v", host, tc.DstAddr, err, want)
+		}
+	}
+}
+
+func TestGetTraceSource(t *testing.T) {
+	tc, err := GetTrace(&Trace{DstAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.SrcAddr != "127.0.0.1" || tc.SrcSockAddr == nil {
+		t.Fatalf("loopback traced from %+v", tc)
+	}
+	tc, err = GetTrace(&Trace{SrcAddr: "10.0.0.1", DstAddr: "127.0.0.1"})
+	if err != nil || tc.SrcAddr != "10.0.0.1" {
+		t.Fatalf("src addr replaced %+v %v", tc, err)
+	}
+}
+
+func TestGetTraceNetns(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("entering a netns takes root on linux")
+	}
+	pid := strconv.Itoa(os.Getpid())
+	if netnsPath(pid) != "/proc/"+pid+"/ns/net" {
+		t.Fatalf("pid %v taken for netns %v", pid, netnsPath(pid))
+	}
+	// the netns of this thread, other tests may move threads of the process
+	// into netns of their own.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	task, err := os.Readlink("/proc/thread-self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	netns := "/proc/" + task + "/ns/net"
+	tc, err := GetTrace(&Trace{DstAddr: "127.0.0.1", Netns: netns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.Netns != netns || tc.SrcAddr != "127.0.0.1" {
+		t.Fatalf("traced from %+v", tc)
+	}
+	if _, err := GetTrace(&Trace{DstAddr: "127.0.0.1", Netns: "/var/run/netns/missing"}); err == nil {
+		t.Fatal("missing netns accepted")
+	}
+}
+
+func TestTraceMarkReroute(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("routes are looked up with a mark on linux only")
+	}
+	tr := newFakeTracer(Config{ICMP: true, Mark: 7}, &fakeNet{})
+	tc, err := GetTrace(&Trace{DstAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tr.newTraceResult(*tc)
+	if err != nil || res.Mark != 7 || res.SrcAddr != "127.0.0.1" || res.SrcSockAddr == nil {
+		t.Fatalf("source not picked again for the mark %+v %v", res.Trace, err)
+	}
+	// a source which cannot be picked again fails the trace.
+	tc.Interface = "missing0"
+	if _, err := tr.newTraceResult(*tc); err == nil {
+		t.Fatal("source picked from a missing interface")
+	}
+	tc.srcRouted = false
+	if res, err := tr.newTraceResult(*tc); err != nil || res.Mark != 7 {
+		t.Fatalf("source given by the trace picked again %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+package go_mtr
+
+import (
+	"net"
+)
+
+// routeSource is the source the kernel picks for dst, learned by connecting
+// a udp socket which sends nothing, bound to iface unless empty.
+func routeSource(dst net.IP, iface string, mark uint32) (net.IP, error) {
+	return dialSource(dst, iface, mark)
+}
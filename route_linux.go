@@ -0,0 +1,145 @@
+package go_mtr
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var errNoPrefSrc = errors.New("route without preferred source")
+
+// routeSource asks the kernel which source it would send to dst from, like
+// "ip route get" does, policy routing rules included. A non empty iface looks
+// the route up through that interface or vrf and a non zero mark for packets
+// with that fwmark, like "ip route get oif iface mark mark".
+func routeSource(dst net.IP, iface string, mark uint32) (net.IP, error) {
+	src, err := netlinkRouteSource(dst, iface, mark)
+	if err == errNoPrefSrc {
+		// some routes, mostly ipv6 ones, leave the source to the socket.
+		return dialSource(dst, iface, mark)
+	}
+	return src, err
+}
+
+func netlinkRouteSource(dst net.IP, iface string, mark uint32) (net.IP, error) {
+	family, addr := unix.AF_INET, dst.To4()
+	if addr == nil {
+		family, addr = unix.AF_INET6, dst.To16()
+	}
+	oif := 0
+	if iface != "" {
+		ifi, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, err
+		}
+		oif = ifi.Index
+	}
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	err = setSockOptRcvTimeout(fd, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return nil, err
+	}
+	req := routeRequest(uint8(family), addr, oif, mark)
+	err = unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Seq != routeRequestSeq {
+				continue
+			}
+			switch msg.Header.Type {
+			case unix.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					return nil, fmt.Errorf("truncated netlink error")
+				}
+				if errno := *(*int32)(unsafe.Pointer(&msg.Data[0])); errno != 0 {
+					return nil, unix.Errno(-errno)
+				}
+			case unix.RTM_NEWROUTE:
+				// x/sys has no netlink parser, the syscall one is frozen but fine.
+				attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+				if err != nil {
+					return nil, err
+				}
+				for _, attr := range attrs {
+					if attr.Attr.Type == unix.RTA_PREFSRC {
+						return net.IP(attr.Value), nil
+					}
+				}
+				return nil, errNoPrefSrc
+			}
+		}
+	}
+}
+
+const routeRequestSeq = 1
+
+// routeRequest is a RTM_GETROUTE message for the host route of addr, out of
+// the interface index oif and for packets marked mark unless zero.
+func routeRequest(family uint8, addr []byte, oif int, mark uint32) []byte {
+	b := make([]byte, unix.SizeofNlMsghdr+unix.SizeofRtMsg)
+	*(*unix.RtMsg)(unsafe.Pointer(&b[unix.SizeofNlMsghdr])) = unix.RtMsg{
+		Family:  family,
+		Dst_len: uint8(len(addr) * 8),
+	}
+	b = appendRtAttr(b, unix.RTA_DST, addr)
+	if oif != 0 {
+		b = appendRtAttr(b, unix.RTA_OIF, rtaUint32(uint32(oif)))
+	}
+	if mark != 0 {
+		b = appendRtAttr(b, unix.RTA_MARK, rtaUint32(mark))
+	}
+	*(*unix.NlMsghdr)(unsafe.Pointer(&b[0])) = unix.NlMsghdr{
+		Len:   uint32(len(b)),
+		Type:  unix.RTM_GETROUTE,
+		Flags: unix.NLM_F_REQUEST,
+		Seq:   routeRequestSeq,
+	}
+	return b
+}
+
+func appendRtAttr(b []byte, typ uint16, value []byte) []byte {
+	attr := make([]byte, rtaAlign(unix.SizeofRtAttr+len(value)))
+	*(*unix.RtAttr)(unsafe.Pointer(&attr[0])) = unix.RtAttr{
+		Len:  uint16(unix.SizeofRtAttr + len(value)),
+		Type: typ,
+	}
+	copy(attr[unix.SizeofRtAttr:], value)
+	return append(b, attr...)
+}
+
+// rtaUint32 is v in the byte order of the host, like netlink wants it.
+func rtaUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&b[0])) = v
+	return b
+}
+
+func rtaAlign(n int) int {
+	return (n + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+}
@@ -0,0 +1,176 @@
+package go_mtr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SessionConfig struct {
+	// Interval between the start of two cycles.
+	Interval time.Duration
+	// Cycles to run, zero keeps probing until the context is done.
+	Cycles   int
+	StartTTL uint8
+	// OnCycle is called after each cycle, Stats may be read from it.
+	OnCycle func(s *Session)
+}
+
+// Session keeps probing every hop of a path in cycles, like mtr does once it
+// has discovered the path with a first traceroute pass.
+type Session struct {
+	tracer Tracer
+	trace  Trace
+	conf   SessionConfig
+	lock   sync.Mutex
+	hops   map[uint8]*hopStats
+	dstTTL uint8
+	cycles int
+}
+
+func NewSession(tracer Tracer, trace Trace, conf SessionConfig) *Session {
+	if conf.StartTTL == 0 {
+		conf.StartTTL = 1
+	}
+	return &Session{
+		tracer: tracer,
+		trace:  trace,
+		conf:   conf,
+		hops:   map[uint8]*hopStats{},
+	}
+}
+
+// Run probes until the configured cycles are done or ctx is done, in which
+// case ctx.Err() is returned.
+func (s *Session) Run(ctx context.Context) error {
+	for {
+		start := time.Now()
+		tc := s.trace
+		tc.Retry = 1
+		s.lock.Lock()
+		if s.dstTTL != 0 {
+			// the path is known, silent hops on it must not end the cycle.
+			tc.MaxTTL = s.dstTTL
+			tc.MaxUnReply = int(s.dstTTL)
+		}
+		s.lock.Unlock()
+		res := s.tracer.BatchTraceContext(ctx, []Trace{tc}, s.conf.StartTTL)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		for _, r := range res {
+			s.add(r)
+		}
+		if s.conf.OnCycle != nil {
+			s.conf.OnCycle(s)
+		}
+		if s.conf.Cycles > 0 && s.Cycles() >= s.conf.Cycles {
+			return nil
+		}
+		wait := time.NewTimer(s.conf.Interval - time.Since(start))
+		select {
+		case <-ctx.Done():
+			wait.Stop()
+			return ctx.Err()
+		case <-wait.C:
+		}
+	}
+}
+
+func (s *Session) add(r TraceResult) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cycles++
+	var lastReply uint8
+	for _, res := range r.Res {
+		h, ok := s.hops[res.TTL]
+		if !ok {
+			h = &hopStats{}
+			s.hops[res.TTL] = h
+		}
+		if res.Latency == 0 {
+			h.miss()
+			continue
+		}
+		h.reply(res)
+		lastReply = res.TTL
+		if res.Reached {
+			s.dstTTL = res.TTL
+		}
+	}
+	// without a reply from the destination keep probing as far as the path answers.
+	if !r.Done && s.dstTTL == 0 && lastReply > 0 {
+		s.dstTTL = lastReply
+	}
+}
+
+func (s *Session) Cycles() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.cycles
+}
+
+// Stats returns the statistics of every hop ordered by ttl.
+func (s *Session) Stats() []HopStat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var stats []HopStat
+	for ttl := s.conf.StartTTL; ttl != 0 && ttl <= s.trace.MaxTTL; ttl++ {
+		h, ok := s.hops[ttl]
+		if !ok {
+			continue
+		}
+		if s.dstTTL != 0 && ttl > s.dstTTL {
+			break
+		}
+		stats = append(stats, h.stat(ttl, s.trace.Percentiles))
+	}
+	return stats
+}
+
+func (s *Session) Marshal() string {
+	line := []string{fmt.Sprintf("%-4s%-24s%7s%6s%8s%8s%8s%8s%8s", "", "Host", "Loss%", "Snt", "Last", "Avg", "Best", "Wrst", "StDev")}
+	for _, h := range s.Stats() {
+		host := hopName(h.Host, h.Hostname)
+		if host == "" {
+			host = "???"
+		}
+		line = append(line, strings.TrimRight(fmt.Sprintf("%3d.%-24s%6.1f%%%6d%8.1f%8.1f%8.1f%8.1f%8.1f  %v",
+			h.TTL,
+			host,
+			h.Loss*100,
+			h.Snt,
+			ms(h.Last),
+			ms(h.Avg),
+			ms(h.Best),
+			ms(h.Wrst),
+			ms(h.StDev),
+			marshalAnnotations(h.Annotations),
+		), " "))
+		// load balanced hops, stacked like mtr does.
+		for _, r := range h.Responders {
+			if r.Host == h.Host {
+				continue
+			}
+			line = append(line, strings.TrimRight(fmt.Sprintf("%4s%-24s%7s%6d%8.1f%8.1f%8.1f%8.1f%8.1f  %v",
+				"",
+				hopName(r.Host, r.Hostname),
+				"",
+				r.Snt,
+				ms(r.Last),
+				ms(r.Avg),
+				ms(r.Best),
+				ms(r.Wrst),
+				ms(r.StDev),
+				marshalAnnotations(r.Annotations),
+			), " "))
+		}
+	}
+	return strings.Join(line, "\n")
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
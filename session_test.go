@@ -0,0 +1,49 @@
+package go_mtr
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	net := &fakeNet{hops: 4, drop: func(ttl uint8) bool { return ttl == 2 }}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 20}, net)
+	cycles := 0
+	s := NewSession(tr, fakeTrace(t), SessionConfig{
+		Interval: time.Millisecond * 10,
+		Cycles:   3,
+		OnCycle:  func(*Session) { cycles++ },
+	})
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stats := s.Stats()
+	if cycles != 3 || len(stats) != 4 {
+		t.Fatalf("unexpected session\n%v", s.Marshal())
+	}
+	for _, h := range stats {
+		if h.Snt != 3 {
+			t.Fatalf("unexpected sent count\n%v", s.Marshal())
+		}
+	}
+	if stats[1].Loss != 1 || stats[3].Loss != 0 || stats[3].Host != "10.0.0.9" || stats[3].Best > stats[3].Wrst {
+		t.Fatalf("unexpected stats\n%v", s.Marshal())
+	}
+}
+
+func TestSessionMarshalResponders(t *testing.T) {
+	s := NewSession(nil, Trace{MaxTTL: 2}, SessionConfig{})
+	for _, host := range []string{"10.0.1.1", "10.0.1.2", "10.0.1.1"} {
+		s.add(TraceResult{Res: []TraceRes{
+			{TTL: 1, SrcTTL: host, Latency: time.Millisecond},
+			{TTL: 2, SrcTTL: "10.0.0.9", Latency: time.Millisecond, Reached: true},
+		}})
+	}
+	lines := strings.Split(s.Marshal(), "\n")
+	// the stacked responder answered 1 of the 3 probes of its ttl.
+	if fields := strings.Fields(lines[2]); len(lines) != 4 || fields[0] != "10.0.1.2" || fields[1] != "3" {
+		t.Fatalf("unexpected responder line\n%v", s.Marshal())
+	}
+}
@@ -0,0 +1,184 @@
+package go_mtr
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// statSampleWindow bounds the round trip times kept for percentiles, in
+// continuous mode they are computed over the latest samples.
+const statSampleWindow = 1024
+
+// HopStat is the statistics of a hop as shown by mtr, Javg, Jmax and Jint
+// being the mean, max and interarrival jitter between consecutive replies.
+type HopStat struct {
+	TTL  uint8
+	Host string
+	// Hostname is the name of Host, when Config.ReverseDNS found one.
+	Hostname string
+	// Annotations of Host by Config.Enrichers.
+	Annotations map[string]string
+	Loss        float32
+	Snt         int
+	Rcv         int
+	Last        time.Duration
+	Avg         time.Duration
+	Best        time.Duration
+	Wrst        time.Duration
+	StDev       time.Duration
+	Javg        time.Duration
+	Jmax        time.Duration
+	Jint        time.Duration
+	// Percentiles of the round trip time, keyed by the requested percentile.
+	Percentiles map[float64]time.Duration
+	// Responders lists every router which answered the ttl in the order they
+	// were first seen, Host being the first. Their Snt is the probes of the
+	// ttl and Rcv those they answered, so load balanced hops show how the
+	// probes were spread.
+	Responders []HopStat
+}
+
+// hopStats accumulates the replies of a hop, it is shared by
+// TraceResult.Aggregate and Session.
+type hopStats struct {
+	host        string
+	hostname    string
+	annotations map[string]string
+	responders  []*hopStats
+	snt         int
+	rcv         int
+	last        time.Duration
+	best        time.Duration
+	wrst        time.Duration
+	mean        float64
+	m2          float64
+	jsum        time.Duration
+	jmax        time.Duration
+	jint        float64
+	samples     []time.Duration
+}
+
+func (h *hopStats) add(rtt time.Duration) {
+	h.snt++
+	h.rcv++
+	if h.rcv > 1 {
+		jitter := rtt - h.last
+		if jitter < 0 {
+			jitter = -jitter
+		}
+		h.jsum += jitter
+		if jitter > h.jmax {
+			h.jmax = jitter
+		}
+		// rfc 3550 interarrival jitter
+		h.jint += (float64(jitter) - h.jint) / 16
+	}
+	h.last = rtt
+	if h.best == 0 || rtt < h.best {
+		h.best = rtt
+	}
+	if rtt > h.wrst {
+		h.wrst = rtt
+	}
+	// welford's online variance
+	delta := float64(rtt) - h.mean
+	h.mean += delta / float64(h.rcv)
+	h.m2 += delta * (float64(rtt) - h.mean)
+	if len(h.samples) >= statSampleWindow {
+		h.samples = h.samples[1:]
+	}
+	h.samples = append(h.samples, rtt)
+}
+
+func (h *hopStats) miss() {
+	h.snt++
+}
+
+// reply accounts the reply res both to the hop and to the router which sent
+// it, its name and annotations are kept once known.
+func (h *hopStats) reply(res TraceRes) {
+	h.add(res.Latency)
+	var r *hopStats
+	for _, rs := range h.responders {
+		if rs.host == res.SrcTTL {
+			r = rs
+			break
+		}
+	}
+	if r == nil {
+		r = &hopStats{host: res.SrcTTL}
+		h.responders = append(h.responders, r)
+	}
+	r.add(res.Latency)
+	r.describe(res)
+	if h.host == "" {
+		h.host = res.SrcTTL
+	}
+	if h.host == res.SrcTTL {
+		h.describe(res)
+	}
+}
+
+func (h *hopStats) describe(res TraceRes) {
+	if res.Hostname != "" {
+		h.hostname = res.Hostname
+	}
+	if res.Annotations != nil {
+		h.annotations = res.Annotations
+	}
+}
+
+func (h *hopStats) stat(ttl uint8, percentiles []float64) HopStat {
+	st := HopStat{
+		TTL:      ttl,
+		Host:     h.host,
+		Hostname: h.hostname,
+		// shared with the results, annotations are never modified.
+		Annotations: h.annotations,
+		Snt:         h.snt,
+		Rcv:         h.rcv,
+		Last:        h.last,
+		Avg:         time.Duration(h.mean),
+		Best:        h.best,
+		Wrst:        h.wrst,
+		Jmax:        h.jmax,
+		Jint:        time.Duration(h.jint),
+	}
+	if h.snt > 0 {
+		st.Loss = float32(h.snt-h.rcv) / float32(h.snt)
+	}
+	if h.rcv > 1 {
+		st.StDev = time.Duration(math.Sqrt(h.m2 / float64(h.rcv-1)))
+		st.Javg = h.jsum / time.Duration(h.rcv-1)
+	}
+	for _, r := range h.responders {
+		rs := r.stat(ttl, percentiles)
+		rs.Snt = h.snt
+		rs.Loss = float32(rs.Snt-rs.Rcv) / float32(rs.Snt)
+		st.Responders = append(st.Responders, rs)
+	}
+	if len(percentiles) > 0 && len(h.samples) > 0 {
+		sorted := append([]time.Duration(nil), h.samples...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i] < sorted[j]
+		})
+		st.Percentiles = map[float64]time.Duration{}
+		for _, p := range percentiles {
+			st.Percentiles[p] = percentile(sorted, p)
+		}
+	}
+	return st
+}
+
+// percentile is the nearest rank p percentile of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
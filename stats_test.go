@@ -0,0 +1,83 @@
+package go_mtr
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHopStats(t *testing.T) {
+	h := &hopStats{}
+	for _, rtt := range []int{10, 20, 10, 40} {
+		h.add(time.Duration(rtt) * time.Millisecond)
+	}
+	h.miss()
+	st := h.stat(3, []float64{50, 95})
+	if st.Snt != 5 || st.Rcv != 4 || st.Loss != 0.2 {
+		t.Fatalf("unexpected counts %+v", st)
+	}
+	if st.Last != 40*time.Millisecond || st.Best != 10*time.Millisecond || st.Wrst != 40*time.Millisecond || st.Avg != 20*time.Millisecond {
+		t.Fatalf("unexpected rtt %+v", st)
+	}
+	// sample stdev of 10 20 10 40 is 14.142ms
+	if st.StDev < 14*time.Millisecond || st.StDev > 15*time.Millisecond {
+		t.Fatalf("unexpected stdev %v", st.StDev)
+	}
+	// jitter 10 10 30
+	if st.Javg < 16*time.Millisecond || st.Javg > 17*time.Millisecond || st.Jmax != 30*time.Millisecond {
+		t.Fatalf("unexpected jitter %+v", st)
+	}
+	if st.Percentiles[50] != 10*time.Millisecond || st.Percentiles[95] != 40*time.Millisecond {
+		t.Fatalf("unexpected percentiles %v", st.Percentiles)
+	}
+}
+
+func TestAggregateStats(t *testing.T) {
+	tr := TraceResult{
+		Trace: Trace{Percentiles: []float64{95}},
+		Res: []TraceRes{
+			{TTL: 1, SrcTTL: "10.0.0.1", Latency: time.Millisecond},
+			{TTL: 1, SrcTTL: "10.0.0.1", Latency: 3 * time.Millisecond},
+			{TTL: 2, PacketLoss: 1},
+			{TTL: 2, SrcTTL: "10.0.0.2", Latency: 2 * time.Millisecond, Reached: true},
+		},
+	}
+	agg := tr.Aggregate()
+	if len(agg.Res) != 2 || tr.Res[0].Latency != time.Millisecond {
+		t.Fatalf("unexpected aggregate %+v", agg.Res)
+	}
+	h := agg.Res[0]
+	if h.Latency != 2*time.Millisecond || h.Stat.Snt != 2 || h.Stat.Percentiles[95] != 3*time.Millisecond {
+		t.Fatalf("unexpected hop %+v", h)
+	}
+	h = agg.Res[1]
+	if h.PacketLoss != 0.5 || h.SrcTTL != "10.0.0.2" || !h.Reached || h.Stat.Rcv != 1 {
+		t.Fatalf("unexpected hop %+v", h)
+	}
+}
+
+func TestAggregateResponders(t *testing.T) {
+	tr := TraceResult{
+		Res: []TraceRes{
+			{TTL: 1, SrcTTL: "10.0.0.1", Latency: time.Millisecond},
+			{TTL: 1, SrcTTL: "10.0.1.1", Latency: 3 * time.Millisecond},
+			{TTL: 1, PacketLoss: 1},
+			{TTL: 1, SrcTTL: "10.0.1.1", Latency: 5 * time.Millisecond},
+		},
+	}
+	agg := tr.Aggregate()
+	if len(agg.Res) != 1 {
+		t.Fatalf("unexpected aggregate %+v", agg.Res)
+	}
+	h := agg.Res[0]
+	if h.SrcTTL != "10.0.0.1" || h.Stat.Snt != 4 || h.Stat.Rcv != 3 || len(h.Stat.Responders) != 2 {
+		t.Fatalf("unexpected hop %+v", h)
+	}
+	r := h.Stat.Responders[1]
+	if r.Host != "10.0.1.1" || r.Snt != 4 || r.Rcv != 2 || r.Avg != 4*time.Millisecond || r.Loss != 0.5 {
+		t.Fatalf("unexpected responder %+v", r)
+	}
+	if lines := strings.Split(agg.MarshalHop(h), "\n"); len(lines) != 2 || !strings.Contains(lines[1], "10.0.1.1") {
+		t.Fatalf("unexpected marshal %q", lines)
+	}
+}
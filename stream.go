@@ -0,0 +1,48 @@
+package go_mtr
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	EventProbeSent  = "ProbeSent"
+	EventProbeReply = "ProbeReply"
+	EventHopDone    = "HopDone"
+	EventTraceDone  = "TraceDone"
+)
+
+// TraceEvent reports the progress of a trace while it runs.
+// ProbeSent and ProbeReply carry the ttl and sequence of a single probe, a
+// ProbeReply also carries the hop found (with Late set when it came after its
+// wait time). HopDone carries the aggregated hop once every retry of a ttl is
+// finished, and TraceDone the final result of the trace.
+type TraceEvent struct {
+	Type   string
+	Id     uint16
+	Key    string
+	TTL    uint8
+	Seq    uint16
+	At     time.Time
+	Hop    TraceRes
+	Result *TraceResult
+}
+
+// BatchTraceStream traces batch like BatchTraceContext but reports every step
+// on the returned channel, which is closed after the last TraceDone event.
+// The channel must be drained, probing waits for the reader. Once ctx is done
+// events the reader does not take are dropped, so a reader may stop reading
+// after cancelling ctx.
+func (t *tracer) BatchTraceStream(ctx context.Context, batch []Trace, startTTL uint8) <-chan TraceEvent {
+	events := make(chan TraceEvent, 100)
+	go func() {
+		defer close(events)
+		t.batchTrace(ctx, batch, startTTL, func(ev TraceEvent) {
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return events
+}
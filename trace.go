@@ -1,10 +1,11 @@
 package go_mtr
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -12,6 +13,11 @@ type Tracer interface {
 	Listen()
 	Close()
 	BatchTrace(batch []Trace, startTTL uint8) []TraceResult
+	BatchTraceContext(ctx context.Context, batch []Trace, startTTL uint8) []TraceResult
+	BatchTraceStream(ctx context.Context, batch []Trace, startTTL uint8) <-chan TraceEvent
+	CompareProtocols(ctx context.Context, trace Trace, startTTL uint8, protocols ...string) ProtocolComparison
+	ConfirmLoss(ctx context.Context, res TraceResult, pacing time.Duration) LossAnalysis
+	Stats() TracerStats
 }
 
 type tracer struct {
@@ -20,8 +26,21 @@ type tracer struct {
 	ipv4          *tracerIpv4
 	ipv6          *tracerIpv6
 	traceResChMap *sync.Map
-	atomId        uint32
+	registry      *probeRegistry
+	limiter       *rateLimiter
+	pool          *tracePool
+	tcpLock       sync.Mutex
+	listenersMu   sync.Mutex
+	listeners     map[listenKey]*listener
+	boundFlows    map[string]int
+	ids           *idAllocator
+	names         *lookupCache
+	annotations   *lookupCache
+	geoip         *GeoIPDB
 	conf          Config
+	// openReceiver and openSender open the sockets of listeners.
+	openReceiver func(proto int, key listenKey) (Receiver, error)
+	openSender   func(key listenKey, mark uint32) (*sendSocket, error)
 }
 
 type tracerIpv4 struct {
@@ -29,6 +48,7 @@ type tracerIpv4 struct {
 	deConstructor DeConstructor
 	detector      Detector
 	receiver      Receiver
+	tcpReceiver   Receiver
 }
 
 type tracerIpv6 struct {
@@ -44,67 +64,115 @@ type TraceResult struct {
 	Trace
 	StartAt    time.Time
 	Done       bool
+	Cancelled  bool
 	AvgPktLoss float32
 	Res        []TraceRes
+	// Err tells why the trace could not be probed, like every id of its flow
+	// being in use or its send socket failing.
+	Err error
 }
 
 func (t TraceResult) Marshal() string {
 	var line []string
 	for _, r := range t.Res {
-		line = append(line, fmt.Sprintf("ttl:%-4d| hop:%-16s| src:%-16s| dst:%-16s|  latency:%13v| packet_loss:%7.2f%%|  reached:%-5v",
-			r.TTL,
-			r.SrcTTL,
-			t.SrcAddr,
-			t.DstAddr,
-			r.Latency.String(),
-			r.PacketLoss*100,
-			r.Reached,
-		))
+		line = append(line, t.MarshalHop(r))
+	}
+	if t.DstName != "" {
+		line = append(line, fmt.Sprintf("dst:%v (%v)", t.DstName, t.DstAddr))
+	}
+	if path := t.ASPath(); len(path) > 0 {
+		line = append(line, fmt.Sprintf("as path:AS%v", strings.Join(path, " AS")))
 	}
 	line = append(line, fmt.Sprintf("debug id:%-5d key:%-35v", t.Id, t.Key))
 	line = append(line, fmt.Sprintf("pkg_loss:%.2f%%", t.AvgPktLoss*100))
 	if t.Done {
 		line = append(line, "trace successed!")
+	} else if t.Cancelled {
+		line = append(line, "trace cancelled!")
+	} else if t.Err != nil {
+		line = append(line, fmt.Sprintf("trace failed! (%v)", t.Err))
 	} else {
 		line = append(line, "trace failed!")
 	}
 	return strings.Join(line, "\n")
 }
 
+func (t TraceResult) MarshalHop(r TraceRes) string {
+	line := fmt.Sprintf("ttl:%-4d| hop:%-16s| src:%-16s| dst:%-16s|  latency:%13v| packet_loss:%7.2f%%|  reached:%-5v|  late:%-5v",
+		r.TTL,
+		hopName(r.SrcTTL, r.Hostname),
+		t.SrcAddr,
+		t.DstAddr,
+		r.Latency.String(),
+		r.PacketLoss*100,
+		r.Reached,
+		r.Late,
+	)
+	if ann := marshalAnnotations(r.Annotations); ann != "" {
+		line += "|  " + ann
+	}
+	if r.Stat.Snt == 0 {
+		return line
+	}
+	st := r.Stat
+	line += fmt.Sprintf("|  snt:%-3d rcv:%-3d best:%v wrst:%v stdev:%v javg:%v jmax:%v",
+		st.Snt, st.Rcv, st.Best, st.Wrst, st.StDev, st.Javg, st.Jmax)
+	for _, p := range t.Percentiles {
+		if v, ok := st.Percentiles[p]; ok {
+			line += fmt.Sprintf(" p%v:%v", p, v)
+		}
+	}
+	// load balanced hops, the other routers are stacked under the first.
+	for _, rs := range st.Responders {
+		if rs.Host == r.SrcTTL {
+			continue
+		}
+		line += fmt.Sprintf("\n%-8s| hop:%-16s| rcv:%d/%d avg:%v best:%v wrst:%v",
+			"", hopName(rs.Host, rs.Hostname), rs.Rcv, rs.Snt, rs.Avg, rs.Best, rs.Wrst)
+		if ann := marshalAnnotations(rs.Annotations); ann != "" {
+			line += "|  " + ann
+		}
+	}
+	return line
+}
+
+// Aggregate merges the probes of every ttl into one hop, whose Latency and
+// PacketLoss are the average of the probes and Stat their full statistics.
+// SrcTTL is the first router which answered, Stat.Responders holds all of them.
 func (t TraceResult) Aggregate() TraceResult {
+	// aggregate into a copy, the hops of t are left untouched.
+	t.Res = append([]TraceRes(nil), t.Res...)
 	var agg []TraceRes
-	var latency time.Duration
-	var successed int
-	var total int
-	var hop string
 	var reached bool
+	var late bool
+	stats := &hopStats{}
 	for idx, r := range t.Res {
-		latency += t.Res[idx].Latency
-		total++
 		if r.Latency != 0 {
-			successed++
-		}
-		// hop = r.SrcTTL
-		if r.SrcTTL != "" && hop == "" {
-			hop = r.SrcTTL
+			stats.reply(r)
+		} else {
+			stats.miss()
 		}
 		if r.Reached {
 			reached = true
 		}
+		if r.Late {
+			late = true
+		}
 		if (idx+1 < len(t.Res) && t.Res[idx+1].TTL != r.TTL) ||
-			// (idx+1 < len(t.Res) && t.Res[idx+1].SrcTTL != hop) ||
 			idx == len(t.Res)-1 {
-			if successed > 0 {
-				t.Res[idx].Latency = latency / time.Duration(successed)
-			}
-			t.Res[idx].PacketLoss = float32(total-successed) / float32(total)
-			t.Res[idx].SrcTTL = hop
+			st := stats.stat(r.TTL, t.Percentiles)
+			t.Res[idx].Latency = st.Avg
+			t.Res[idx].PacketLoss = st.Loss
+			t.Res[idx].SrcTTL = st.Host
+			t.Res[idx].Hostname = st.Hostname
 			t.Res[idx].Reached = reached
-			hop = ""
+			t.Res[idx].Late = late
+			t.Res[idx].Stat = st
+			t.Res[idx].Annotations = st.Annotations
 			agg = append(agg, t.Res[idx])
-			successed = 0
-			total = 0
-			latency = 0
+			stats = &hopStats{}
+			reached = false
+			late = false
 		}
 	}
 	t.Res = agg
@@ -117,6 +185,16 @@ func (t TraceResult) MarshalAggregate() string {
 }
 
 func NewTrace(conf Config) (Tracer, error) {
+	var geoip *GeoIPDB
+	if conf.GeoIPDB != "" {
+		db, err := OpenGeoIPDB(conf.GeoIPDB, conf.GeoIPReload)
+		if err != nil {
+			return nil, err
+		}
+		geoip = db
+		// the enrichers of the caller are left untouched.
+		conf.Enrichers = append(conf.Enrichers[:len(conf.Enrichers):len(conf.Enrichers)], db)
+	}
 	ipv4, err := tracerI4(conf)
 	if err != nil {
 		return nil, err
@@ -126,11 +204,20 @@ func NewTrace(conf Config) (Tracer, error) {
 		return nil, err
 	}
 	tc := &tracer{
+		geoip:         geoip,
 		nextHopWait:   conf.NextHopWait,
 		maxUnReply:    conf.MaxUnReply,
 		ipv4:          ipv4,
 		ipv6:          ipv6,
 		traceResChMap: &sync.Map{},
+		registry:      newProbeRegistry(),
+		limiter:       newRateLimiter(conf),
+		pool:          newTracePool(conf.MaxConcurrentTraces),
+		ids:           newIdAllocator(),
+		names:         newReverseDNS(conf),
+		annotations:   newEnrichment(conf),
+		openReceiver:  openReceiver,
+		openSender:    openSender,
 		conf:          conf,
 	}
 	return tc, nil
@@ -168,31 +255,47 @@ func tracerI6(conf Config) (*tracerIpv6, error) {
 	}, nil
 }
 
-func (t *tracer) getAtomId() uint16 {
-	n := atomic.AddUint32(&t.atomId, 1)
-	return uint16(n % 65535)
-}
-
-func (t *tracer) tracerKey(id uint16, src string, srcPort uint16, dst string, dstPort uint16) string {
-	if t.conf.UDP {
-		key := fmt.Sprintf("%v:%v:%v-%v:%v", id, src, srcPort, dst, dstPort)
-		return key
-	}
-	if t.conf.ICMP {
-		key := fmt.Sprintf("%v:%v-%v", id, src, dst)
-		return key
-	}
-	return fmt.Sprintf("%v:%v-%v", id, src, dst)
+// tracerKey identifies the replies of a trace, those of a trace bound to a
+// netns or an interface only match when received through it.
+func (t *tracer) tracerKey(proto uint8, id uint16, at listenKey, src string, srcPort uint16, dst string, dstPort uint16) string {
+	return fmt.Sprintf("%v/%v%v", id, flowKey(proto, src, srcPort, dst, dstPort), at)
 }
 
 func (t *tracer) handleRcv(rcv *ICMPRcv) {
-	key := t.tracerKey(rcv.Id, rcv.Src, rcv.SrcPort, rcv.Dst, rcv.DstPort)
+	if rcv.RcvType == TCPReply && !t.ids.inUse(flowKey(rcv.Proto, rcv.Src, rcv.SrcPort, rcv.Dst, rcv.DstPort)) {
+		// the tcp receiver sees every segment of the host, those of other
+		// connections are not replies gone astray.
+		return
+	}
+	key := t.tracerKey(rcv.Proto, rcv.Id, listenKey{netns: rcv.Netns, iface: rcv.Interface}, rcv.Src, rcv.SrcPort, rcv.Dst, rcv.DstPort)
 	chI, ok := t.traceResChMap.Load(key)
 	if !ok {
+		if !t.unmatchedElsewhere(rcv) {
+			t.registry.countUnmatched()
+		}
+		return
+	}
+	probe, err := t.registry.match(key, rcv)
+	if err != nil && err != errProbeLate {
 		return
 	}
-	ch := chI.(chan *ICMPRcv)
-	ch <- rcv
+	if rcv.RcvType == ICMPTimeExceed {
+		t.limiter.learn(probe.dst, probe.ttl, rcv.TTLSrc)
+	}
+	t.names.start(rcv.TTLSrc)
+	t.annotations.start(rcv.TTLSrc)
+	ch := chI.(chan *probeReply)
+	ch <- &probeReply{
+		rcv:   rcv,
+		probe: probe,
+		late:  err == errProbeLate,
+	}
+}
+
+func (t *tracer) Stats() TracerStats {
+	st := t.registry.stats()
+	st.Running, st.QueueDepth = t.pool.stats()
+	return st
 }
 
 func (t *tracer) Listen() {
@@ -218,32 +321,132 @@ func (t *tracer) Listen() {
 	}()
 }
 
+// listenTCP opens the tcp receiver the first time a tcp trace runs, so a
+// tracer which never probes with tcp does not see every segment of the host.
+// A receiver which cannot be opened fails the trace, the next one tries again.
+func (t *tracer) listenTCP() error {
+	t.tcpLock.Lock()
+	defer t.tcpLock.Unlock()
+	if t.ipv4.tcpReceiver != nil {
+		return nil
+	}
+	rcv, err := newRcvIpv4TCP()
+	if err != nil {
+		return fmt.Errorf("open tcp receiver error (%v)", err)
+	}
+	t.ipv4.tcpReceiver = rcv
+	ch := rcv.Receive()
+	go func() {
+		for msg := range ch {
+			rcv, err := t.ipv4.deConstructor.DeConstruct(msg)
+			if err != nil {
+				continue
+			}
+			t.handleRcv(rcv)
+		}
+	}()
+	return nil
+}
+
+// listenFor opens the receivers the replies of b arrive on, when not yet open.
+func (t *tracer) listenFor(b Trace) error {
+	if b.Protocol == ProtoTCP {
+		err := t.listenTCP()
+		if err != nil {
+			return err
+		}
+	}
+	if key := b.listenKey(); key != (listenKey{}) {
+		return t.listen(key, b.flow(), b.Protocol == ProtoTCP)
+	}
+	return nil
+}
+
+// unlistenFor releases the receivers listenFor opened for b.
+func (t *tracer) unlistenFor(b Trace) {
+	if key := b.listenKey(); key != (listenKey{}) {
+		t.unlisten(key, b.flow())
+	}
+}
+
 func (t *tracer) Close() {
+	t.tcpLock.Lock()
+	if t.ipv4.tcpReceiver != nil {
+		t.ipv4.tcpReceiver.Close()
+	}
+	t.tcpLock.Unlock()
+	t.closeListeners()
 	t.ipv4.detector.Close()
 	t.ipv4.receiver.Close()
 	t.ipv6.detector.Close()
 	t.ipv6.receiver.Close()
+	if t.geoip != nil {
+		t.geoip.Close()
+	}
 }
 
 func (t *tracer) BatchTrace(batch []Trace, startTTL uint8) []TraceResult {
+	return t.BatchTraceContext(context.Background(), batch, startTTL)
+}
+
+// BatchTraceContext stops probing once ctx is done, traces which have not
+// finished by then are returned with the hops found so far and Cancelled set.
+func (t *tracer) BatchTraceContext(ctx context.Context, batch []Trace, startTTL uint8) []TraceResult {
+	return t.batchTrace(ctx, batch, startTTL, func(TraceEvent) {})
+}
+
+func (t *tracer) batchTrace(ctx context.Context, batch []Trace, startTTL uint8, emit func(TraceEvent)) []TraceResult {
 	if len(batch) == 0 {
 		return nil
 	}
 	var result []TraceResult
 	ch := make(chan *TraceResult, len(batch))
-	for idx, b := range batch {
-		atomId := t.getAtomId()
-		key := t.tracerKey(atomId, b.SrcAddr, b.SrcPort, b.DstAddr, b.DstPort)
-		tr := TraceResult{
-			Id:      atomId,
-			Key:     key,
-			Trace:   batch[idx],
-			StartAt: time.Time{},
-			Done:    false,
-			Res:     []TraceRes{},
-		}
-		go t.trace(startTTL, &tr, ch)
+	// admit traces one after the other, so a large batch waiting for the
+	// pool holds no goroutine, timer or reply channel per trace.
+	order := make([]int, len(batch))
+	for idx := range order {
+		order[idx] = idx
 	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return batch[order[i]].Priority > batch[order[j]].Priority
+	})
+	t.pool.enqueue(len(batch))
+	go func() {
+		for n, idx := range order {
+			err := t.pool.acquire(ctx, batch[idx].Priority)
+			if err != nil {
+				t.pool.drop(len(order) - n)
+				for _, idx := range order[n:] {
+					tr, _ := t.newTraceResult(batch[idx])
+					tr.Cancelled = true
+					t.finish(tr, ch, emit)
+				}
+				return
+			}
+			tr, err := t.newTraceResult(batch[idx])
+			if err == nil {
+				err = t.listenFor(tr.Trace)
+			}
+			if err != nil {
+				tr.Err = err
+				t.pool.release()
+				t.finish(tr, ch, emit)
+				continue
+			}
+			err = t.assignId(tr)
+			if err != nil {
+				t.unlistenFor(tr.Trace)
+				t.pool.release()
+				t.finish(tr, ch, emit)
+				continue
+			}
+			go func() {
+				t.trace(ctx, startTTL, tr, emit)
+				t.pool.release()
+				t.finish(tr, ch, emit)
+			}()
+		}
+	}()
 	for r := range ch {
 		if r == nil {
 			break
@@ -257,118 +460,389 @@ func (t *tracer) BatchTrace(batch []Trace, startTTL uint8) []TraceResult {
 	return result
 }
 
-func (t *tracer) trace(startTTL uint8, tc *TraceResult, resCh chan *TraceResult) {
-	var err error
-	var reached bool
-	ch := make(chan *ICMPRcv, 100)
-	t.traceResChMap.Store(tc.Key, ch)
-	defer t.traceResChMap.Delete(tc.Key)
-	unReply := 0
-	total := 0
-	loss := 0
+// newTraceResult fails when the source of b cannot be picked again for the
+// mark of Config, the result is returned all the same.
+func (t *tracer) newTraceResult(b Trace) (*TraceResult, error) {
+	err := t.withDefaults(&b)
+	return &TraceResult{
+		Trace:   b,
+		StartAt: time.Time{},
+		Done:    false,
+		Res:     []TraceRes{},
+	}, err
+}
+
+// assignId gives tc an id no other live trace of its flow uses, closeRun
+// hands it back. tc fails with the error when there is none left.
+func (t *tracer) assignId(tc *TraceResult) error {
+	id, err := t.ids.acquire(tc.flow())
+	if err != nil {
+		tc.Err = err
+		return err
+	}
+	tc.Id = id
+	tc.Key = t.tracerKey(protoNumber(tc.Protocol), id, tc.listenKey(), tc.SrcAddr, tc.SrcPort, tc.DstAddr, tc.DstPort)
+	return nil
+}
+
+// withDefaults fills the probe options a trace leaves unset from Config.
+func (t *tracer) withDefaults(b *Trace) error {
+	if b.Protocol == "" {
+		b.Protocol = t.conf.protocol()
+	}
+	if b.NextHopWait <= 0 {
+		b.NextHopWait = t.nextHopWait
+	}
+	if b.MaxUnReply <= 0 {
+		b.MaxUnReply = t.maxUnReply
+	}
+	if b.Percentiles == nil {
+		b.Percentiles = t.conf.Percentiles
+	}
+	if b.Mark == 0 && t.conf.Mark != 0 {
+		b.Mark = t.conf.Mark
+		if b.srcRouted {
+			// GetTrace picked the source from the unmarked route.
+			return b.reroute()
+		}
+	}
+	return nil
+}
+
+type probeReply struct {
+	rcv   *ICMPRcv
+	probe *probeState
+	late  bool
+}
+
+// traceRun is the state of a single trace while it is being probed.
+type traceRun struct {
+	ctx         context.Context
+	tc          *TraceResult
+	emit        func(TraceEvent)
+	names       *lookupCache
+	annotations *lookupCache
+	replies     chan *probeReply
+	// index of the result recorded for every probe, so late replies can be
+	// put back on the ttl they were sent with.
+	seqRes  map[uint16]int
+	seq     uint16
+	total   int
+	loss    int
+	unReply int
+	reached bool
+}
+
+func nextSeq(seq uint16) uint16 {
+	seq++
+	if seq == 0 {
+		seq = 1
+	}
+	return seq
+}
+
+// reached tells whether rp comes from the destination. Routers on the way
+// may answer with unreachable too, when they filter the probes.
+func (rp *probeReply) reached() bool {
+	switch rp.rcv.RcvType {
+	case ICMPEcho, TCPReply:
+		return true
+	case ICMPUnreachable:
+		return rp.rcv.TTLSrc == rp.probe.dst
+	}
+	return false
+}
+
+func (t *tracer) sendProbe(ctx context.Context, tc *TraceResult, ttl uint8, seq uint16) (*probeState, error) {
+	constructor, detector := t.ipv4.constructor, t.ipv4.detector
+	if !tc.IsIpv4 {
+		constructor, detector = t.ipv6.constructor, t.ipv6.detector
+	}
+	pkg, err := constructor.Packet(ConstructPacket{
+		Trace:   tc.Trace,
+		TTL:     ttl,
+		Id:      tc.Id,
+		Seq:     seq,
+		SrcPort: tc.SrcPort,
+		DstPort: tc.DstPort,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var sock *sendSocket
+	if key := tc.listenKey(); key != (listenKey{}) {
+		sock, err = t.sendSocket(key, tc.Mark)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = t.limiter.wait(ctx, tc.DstAddr, ttl)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	probe := &probeState{
+		proto:  protoNumber(tc.Protocol),
+		dst:    tc.DstAddr,
+		ttl:    ttl,
+		seq:    seq,
+		sentAt: start,
+		expire: start.Add(tc.NextHopWait),
+	}
+	t.registry.register(tc.Key, probe)
+	err = detector.Probe(SendProbe{
+		Trace:        tc.Trace,
+		WriteTimeout: time.Duration(1) * time.Second,
+		Msg:          pkg,
+		sock:         sock,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return probe, nil
+}
+
+func (t *tracer) trace(ctx context.Context, startTTL uint8, tc *TraceResult, emit func(TraceEvent)) {
+	if tc.Timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, tc.Timeout)
+		defer cancel()
+	}
+	run := t.newRun(ctx, tc, emit)
+	if t.conf.TTLWindow > 1 {
+		t.traceParallel(run, startTTL)
+	} else {
+		t.traceSerial(run, startTTL)
+	}
+	t.closeRun(run)
+}
+
+// newRun starts routing the replies of tc to a new run, closeRun must be
+// called once probing is over.
+func (t *tracer) newRun(ctx context.Context, tc *TraceResult, emit func(TraceEvent)) *traceRun {
+	tc.StartAt = time.Now()
+	run := &traceRun{
+		ctx:         ctx,
+		tc:          tc,
+		emit:        emit,
+		names:       t.names,
+		annotations: t.annotations,
+		replies:     make(chan *probeReply, 100),
+		seqRes:      map[uint16]int{},
+	}
+	t.traceResChMap.Store(tc.Key, run.replies)
+	return run
+}
+
+func (t *tracer) closeRun(run *traceRun) {
+	tc := run.tc
+	t.traceResChMap.Delete(tc.Key)
+	t.registry.release(tc.Key)
+	t.ids.release(tc.flow(), tc.Id)
+	t.unlistenFor(tc.Trace)
+	if run.total > 0 {
+		tc.AvgPktLoss = float32(run.loss) / float32(run.total)
+	}
+}
+
+func (t *tracer) finish(tc *TraceResult, resCh chan *TraceResult, emit func(TraceEvent)) {
+	t.describe(tc)
+	res := *tc
+	emit(TraceEvent{
+		Type:   EventTraceDone,
+		Id:     tc.Id,
+		Key:    tc.Key,
+		At:     time.Now(),
+		Result: &res,
+	})
+	resCh <- tc
+}
+
+func (t *tracer) traceSerial(run *traceRun, startTTL uint8) {
+	tc := run.tc
 	for ttl := startTTL; ttl <= tc.MaxTTL; ttl++ {
-		ttlWithReply := false
-		for r := 0; r < tc.Retry; r++ {
-			var pkg []byte
-			total++
-			start := time.Now()
-			if tc.IsIpv4 {
-				pkg, err = t.ipv4.constructor.Packet(ConstructPacket{
-					Trace:   tc.Trace,
-					TTL:     uint8(ttl),
-					Id:      tc.Id,
-					Seq:     uint16(ttl),
-					SrcPort: tc.SrcPort,
-					DstPort: tc.DstPort,
-				})
-				if err != nil {
-					continue
-				}
-				err = t.ipv4.detector.Probe(SendProbe{
-					Trace:        tc.Trace,
-					WriteTimeout: time.Duration(1) * time.Second,
-					Msg:          pkg,
-				})
-				if err != nil {
-					continue
-				}
+		replied := t.probeTTL(run, ttl)
+		if tc.Cancelled {
+			return
+		}
+		if run.hopFinished(ttl, replied) {
+			return
+		}
+	}
+}
+
+// probeTTL sends the retries of ttl one after the other, waiting for the reply
+// of each, and tells whether any of them was answered.
+func (t *tracer) probeTTL(run *traceRun, ttl uint8) bool {
+	tc := run.tc
+	ttlWithReply := false
+	for r := 0; r < tc.Retry; r++ {
+		if run.ctx.Err() != nil {
+			tc.Cancelled = true
+			return ttlWithReply
+		}
+		run.total++
+		run.seq = nextSeq(run.seq)
+		probe, err := t.sendProbe(run.ctx, tc, ttl, run.seq)
+		if err != nil {
+			if run.ctx.Err() != nil {
+				run.total--
 			} else {
-				pkg, err = t.ipv6.constructor.Packet(ConstructPacket{
-					Trace:   tc.Trace,
-					TTL:     uint8(ttl),
-					Id:      tc.Id,
-					Seq:     uint16(ttl),
-					SrcPort: tc.SrcPort,
-					DstPort: tc.DstPort,
-				})
-				if err != nil {
-					continue
-				}
-				err := t.ipv6.detector.Probe(SendProbe{
-					Trace:        tc.Trace,
-					WriteTimeout: time.Duration(1) * time.Second,
-					Msg:          pkg,
-				})
-				if err != nil {
-					continue
-				}
+				run.sendFailed(ttl, err)
 			}
-			to := time.NewTimer(t.nextHopWait)
-		For:
-			for {
-				select {
-				case <-to.C:
-					loss++
-					tc.Res = append(tc.Res, TraceRes{
-						Latency:    0,
-						TTL:        ttl,
-						PacketLoss: 1,
-					})
-					break For
-				case rcv := <-ch:
-					ttlWithReply = true
-					r := TraceRes{
-						SrcTTL:  rcv.TTLSrc,
-						Latency: time.Since(start),
-						TTL:     ttl,
-						Reached: false,
-					}
-					if rcv.RcvType == ICMPEcho || rcv.RcvType == ICMPUnreachable {
-						r.Reached = true
-						tc.Done = true
-						tc.Res = append(tc.Res, r)
-						tc.AvgPktLoss = float32(loss) / float32(total)
-						reached = true
-						break For
-					}
-					if r.Reached {
-						tc.Done = true
-						tc.Res = append(tc.Res, r)
-						tc.AvgPktLoss = float32(loss) / float32(total)
-						reached = true
-						break For
-					}
-					tc.Res = append(tc.Res, r)
-					break For
+			continue
+		}
+		run.probeSent(probe)
+		to := time.NewTimer(tc.NextHopWait)
+	For:
+		for {
+			select {
+			case <-run.ctx.Done():
+				// the probe in flight is neither answered nor lost.
+				to.Stop()
+				run.total--
+				tc.Cancelled = true
+				return ttlWithReply
+			case <-to.C:
+				run.timeout(probe)
+				break For
+			case rp := <-run.replies:
+				if rp.probe != probe {
+					run.lateReply(rp)
+					continue
 				}
+				to.Stop()
+				ttlWithReply = true
+				run.reply(rp)
+				break For
 			}
 		}
-		if !ttlWithReply {
-			unReply++
-			if unReply >= t.maxUnReply {
-				tc.AvgPktLoss = float32(loss) / float32(total)
-				resCh <- tc
-				return
+	}
+	return ttlWithReply
+}
+
+// hopFinished reports the hop once all its probes are done and tells whether
+// probing should stop after it.
+func (run *traceRun) hopFinished(ttl uint8, replied bool) bool {
+	run.hopDone(ttl)
+	if replied {
+		run.unReply = 0
+	} else {
+		run.unReply++
+	}
+	return run.reached || run.unReply >= run.tc.MaxUnReply
+}
+
+func (run *traceRun) event(typ string, probe *probeState) TraceEvent {
+	return TraceEvent{
+		Type: typ,
+		Id:   run.tc.Id,
+		Key:  run.tc.Key,
+		TTL:  probe.ttl,
+		Seq:  probe.seq,
+		At:   time.Now(),
+	}
+}
+
+func (run *traceRun) probeSent(probe *probeState) {
+	ev := run.event(EventProbeSent, probe)
+	ev.At = probe.sentAt
+	run.emit(ev)
+}
+
+func (run *traceRun) timeout(probe *probeState) {
+	run.loss++
+	run.seqRes[probe.seq] = len(run.tc.Res)
+	run.tc.Res = append(run.tc.Res, TraceRes{
+		Latency:    0,
+		TTL:        probe.ttl,
+		PacketLoss: 1,
+	})
+}
+
+// sendFailed records a probe which could not be sent as lost, the trace fails
+// with err when its send socket is at fault.
+func (run *traceRun) sendFailed(ttl uint8, err error) {
+	run.loss++
+	run.tc.Res = append(run.tc.Res, TraceRes{
+		TTL:        ttl,
+		PacketLoss: 1,
+	})
+	if _, ok := err.(*sendSocketError); ok && run.tc.Err == nil {
+		run.tc.Err = err
+	}
+}
+
+func (run *traceRun) reply(rp *probeReply) {
+	r := TraceRes{
+		SrcTTL:      rp.rcv.TTLSrc,
+		Hostname:    run.names.hostname(rp.rcv.TTLSrc),
+		Annotations: run.annotations.annotations(rp.rcv.TTLSrc),
+		Latency:     rp.rcv.RcvAt.Sub(rp.probe.sentAt),
+		TTL:         rp.probe.ttl,
+		Reached:     false,
+		Late:        rp.late,
+	}
+	if rp.reached() {
+		r.Reached = true
+		run.tc.Done = true
+		run.reached = true
+	}
+	run.seqRes[rp.probe.seq] = len(run.tc.Res)
+	run.tc.Res = append(run.tc.Res, r)
+	ev := run.event(EventProbeReply, rp.probe)
+	ev.Hop = r
+	run.emit(ev)
+}
+
+// lateReply records a reply to a probe which already timed out on the result
+// of that probe instead of the one currently waited for.
+func (run *traceRun) lateReply(rp *probeReply) {
+	idx, ok := run.seqRes[rp.probe.seq]
+	if !ok {
+		return
+	}
+	run.loss--
+	res := &run.tc.Res[idx]
+	res.SrcTTL = rp.rcv.TTLSrc
+	res.Hostname = run.names.hostname(rp.rcv.TTLSrc)
+	res.Annotations = run.annotations.annotations(rp.rcv.TTLSrc)
+	res.Latency = rp.rcv.RcvAt.Sub(rp.probe.sentAt)
+	res.PacketLoss = 0
+	res.Late = true
+	if rp.reached() {
+		res.Reached = true
+		run.tc.Done = true
+		run.reached = true
+	}
+	ev := run.event(EventProbeReply, rp.probe)
+	ev.Hop = *res
+	run.emit(ev)
+}
+
+func (run *traceRun) hopDone(ttl uint8) {
+	var res []TraceRes
+	for _, r := range run.tc.Res {
+		if r.TTL == ttl {
+			if r.Hostname == "" {
+				r.Hostname = run.names.hostname(r.SrcTTL)
 			}
-		} else {
-			unReply = 0
-		}
-		if reached {
-			break
+			if r.Annotations == nil {
+				r.Annotations = run.annotations.annotations(r.SrcTTL)
+			}
+			res = append(res, r)
 		}
 	}
-	if total > 0 {
-		tc.AvgPktLoss = float32(loss) / float32(total)
+	if len(res) == 0 {
+		return
 	}
-	resCh <- tc
+	agg := TraceResult{Res: res}.Aggregate()
+	run.emit(TraceEvent{
+		Type: EventHopDone,
+		Id:   run.tc.Id,
+		Key:  run.tc.Key,
+		TTL:  ttl,
+		At:   time.Now(),
+		Hop:  agg.Res[0],
+	})
 }
@@ -1,6 +1,8 @@
 package go_mtr
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
 	"sync"
 	"testing"
@@ -91,3 +93,565 @@ func TestTraceBatch(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// fakeNet answers probes like a path of hops routers, the last one being the
+// destination, without touching the network.
+type fakeNet struct {
+	tr    *tracer
+	hops  uint8
+	delay time.Duration
+	drop  func(ttl uint8) bool
+	// filter drops probes of a protocol from ttl on.
+	filter map[uint8]uint8
+	// prohibit has the router of ttl answer the probes of a protocol reaching
+	// it with admin prohibited.
+	prohibit map[uint8]uint8
+	// netns and iface the replies are received through.
+	netns string
+	iface string
+	// mark routes probes to the hops, other probes are dropped.
+	mark uint32
+	// receivers and send sockets opened for listeners, and receivers open.
+	// Receivers fail with listenErr and send sockets with sendErr.
+	listenErr error
+	sendErr   error
+	lock      sync.Mutex
+	receivers int
+	senders   int
+	open      int
+}
+
+func (f *fakeNet) openReceiver() Receiver {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.receivers++
+	f.open++
+	return &fakeRcv{net: f, ch: make(chan []byte)}
+}
+
+// fakeRcv is a listener receiver, replies are handed to the tracer by fakeNet.
+type fakeRcv struct {
+	net *fakeNet
+	ch  chan []byte
+}
+
+func (r *fakeRcv) Receive() chan []byte {
+	return r.ch
+}
+
+func (r *fakeRcv) Close() {
+	r.net.lock.Lock()
+	defer r.net.lock.Unlock()
+	r.net.open--
+	close(r.ch)
+}
+
+func (f *fakeNet) Probe(req SendProbe) error {
+	msg := append([]byte(nil), req.Msg...)
+	ttl := msg[8]
+	if f.drop != nil && f.drop(ttl) {
+		return nil
+	}
+	if from, ok := f.filter[msg[9]]; ok && ttl >= from {
+		return nil
+	}
+	if req.Mark != f.mark {
+		return nil
+	}
+	go func() {
+		time.Sleep(f.delay)
+		var bts []byte
+		if from, ok := f.prohibit[msg[9]]; ok && ttl >= from {
+			bts = icmpError(3, 13, [4]byte{10, 0, from, 1}, msg)
+		} else if ttl < f.hops {
+			bts = timeExceeded([4]byte{10, 0, ttl, 1}, msg)
+		} else if msg[9] == protoNumICMP {
+			bts = echoReply(msg)
+		} else if msg[9] == protoNumTCP {
+			bts = synAck(msg)
+		} else {
+			var dst [4]byte
+			copy(dst[:], msg[16:20])
+			bts = icmpError(3, 3, dst, msg)
+		}
+		rcv, err := newDeconstructIpv4().DeConstruct(bts)
+		if err != nil {
+			return
+		}
+		if f.netns != "" || f.iface != "" {
+			// the host receivers see the replies of the interface too.
+			host := *rcv
+			f.tr.handleRcv(&host)
+		}
+		rcv.Netns = f.netns
+		rcv.Interface = f.iface
+		f.tr.handleRcv(rcv)
+	}()
+	return nil
+}
+
+func (f *fakeNet) Close() {}
+
+func echoReply(probe []byte) []byte {
+	bts := make([]byte, 512)
+	bts[0] = 0x45
+	bts[9] = 1
+	copy(bts[12:16], probe[16:20])
+	copy(bts[16:20], probe[12:16])
+	copy(bts[24:28], probe[24:28])
+	return bts
+}
+
+func synAck(probe []byte) []byte {
+	bts := make([]byte, 512)
+	bts[0] = 0x45
+	bts[9] = protoNumTCP
+	copy(bts[12:16], probe[16:20])
+	copy(bts[16:20], probe[12:16])
+	copy(bts[20:22], probe[22:24])
+	copy(bts[22:24], probe[20:22])
+	binary.BigEndian.PutUint32(bts[28:32], binary.BigEndian.Uint32(probe[24:28])+1)
+	bts[33] = 0x12
+	return bts
+}
+
+func newFakeTracer(conf Config, net *fakeNet) *tracer {
+	tr := &tracer{
+		nextHopWait: conf.NextHopWait,
+		maxUnReply:  conf.MaxUnReply,
+		ipv4: &tracerIpv4{
+			constructor:   newConstructIpv4(conf),
+			deConstructor: newDeconstructIpv4(),
+			detector:      net,
+			receiver:      &rcvMock{},
+		},
+		ipv6: &tracerIpv6{
+			constructor:   newConstructIpv6(conf),
+			deConstructor: newDeconstructIpv6(),
+			detector:      newProbeIpv6(),
+			receiver:      &rcvMock{},
+		},
+		traceResChMap: &sync.Map{},
+		registry:      newProbeRegistry(),
+		limiter:       newRateLimiter(conf),
+		pool:          newTracePool(conf.MaxConcurrentTraces),
+		ids:           newIdAllocator(),
+		names:         newReverseDNS(conf),
+		annotations:   newEnrichment(conf),
+		conf:          conf,
+		openReceiver: func(proto int, key listenKey) (Receiver, error) {
+			if net.listenErr != nil {
+				return nil, net.listenErr
+			}
+			return net.openReceiver(), nil
+		},
+		openSender: func(key listenKey, mark uint32) (*sendSocket, error) {
+			if net.sendErr != nil {
+				return nil, &sendSocketError{err: net.sendErr}
+			}
+			net.lock.Lock()
+			defer net.lock.Unlock()
+			net.senders++
+			return &sendSocket{fd: -1}, nil
+		},
+	}
+	net.tr = tr
+	tr.ipv4.tcpReceiver = &rcvMock{}
+	return tr
+}
+
+func fakeTrace(t *testing.T) Trace {
+	tc, err := GetTrace(&Trace{
+		SrcAddr: "10.0.0.1",
+		DstAddr: "10.0.0.9",
+		SrcPort: 65533,
+		DstPort: 65535,
+		MaxTTL:  30,
+		Retry:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *tc
+}
+
+func TestFakeTrace(t *testing.T) {
+	net := &fakeNet{hops: 5, drop: func(ttl uint8) bool { return ttl == 2 }}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 50}, net)
+	res := tr.BatchTrace([]Trace{fakeTrace(t)}, 1)
+	if len(res) != 1 || !res[0].Done || len(res[0].Res) != 5 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if res[0].Res[1].PacketLoss != 1 || res[0].Res[2].SrcTTL != "10.0.3.1" || !res[0].Res[4].Reached {
+		t.Fatalf("unexpected hops\n%v", res[0].Marshal())
+	}
+}
+
+func TestFakeTraceBound(t *testing.T) {
+	cases := []struct {
+		name  string
+		net   *fakeNet
+		mark  uint32
+		trace func(tc *Trace)
+		// other is a trace of the same flow run alongside, which must not
+		// match the replies.
+		other func(tc *Trace)
+		done  bool
+		err   bool
+	}{
+		{
+			name:  "interface",
+			net:   &fakeNet{hops: 3, iface: "vrf-blue"},
+			trace: func(tc *Trace) { tc.Interface = "vrf-blue" },
+			done:  true,
+		},
+		{
+			// the same replies received outside the vrf belong to another trace.
+			name:  "other interface",
+			net:   &fakeNet{hops: 3},
+			trace: func(tc *Trace) { tc.Interface = "vrf-blue" },
+		},
+		{
+			name:  "interface unavailable",
+			net:   &fakeNet{hops: 3, iface: "vrf-blue", listenErr: fmt.Errorf("no such device")},
+			trace: func(tc *Trace) { tc.Interface = "vrf-blue" },
+			err:   true,
+		},
+		{
+			// a tenant of another netns tracing the very same flow.
+			name:  "netns",
+			net:   &fakeNet{hops: 3, netns: "/var/run/netns/blue"},
+			trace: func(tc *Trace) { tc.Netns = "/var/run/netns/blue" },
+			other: func(tc *Trace) { tc.Netns = "/var/run/netns/red" },
+			done:  true,
+		},
+		{
+			name:  "mark of the tracer",
+			net:   &fakeNet{hops: 3, mark: 7},
+			mark:  7,
+			trace: func(tc *Trace) {},
+			done:  true,
+		},
+		{
+			name:  "mark of the trace",
+			net:   &fakeNet{hops: 3, mark: 7},
+			mark:  7,
+			trace: func(tc *Trace) { tc.Mark = 8 },
+		},
+	}
+	for _, c := range cases {
+		tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 2, NextHopWait: time.Millisecond * 20, Mark: c.mark}, c.net)
+		tc := fakeTrace(t)
+		c.trace(&tc)
+		traces := []Trace{tc}
+		if c.other != nil {
+			other := tc
+			c.other(&other)
+			traces = append(traces, other)
+		}
+		res := tr.BatchTrace(traces, 1)
+		r := res[0]
+		switch {
+		case c.err:
+			if r.Err == nil || len(r.Res) != 0 || len(tr.listeners) != 0 {
+				t.Fatalf("%v: trace without receiver not failed %+v", c.name, r)
+			}
+		case c.done:
+			if !r.Done || len(r.Res) != 3 {
+				t.Fatalf("%v: replies not matched\n%v", c.name, r.Marshal())
+			}
+			if st := tr.Stats(); st.Unmatched != 0 {
+				t.Fatalf("%v: host receivers counted the replies unmatched %+v", c.name, st)
+			}
+		default:
+			if r.Done || r.AvgPktLoss != 1 {
+				t.Fatalf("%v: replies matched\n%v", c.name, r.Marshal())
+			}
+		}
+		mark := tc.Mark
+		if mark == 0 {
+			mark = c.mark
+		}
+		if r.Mark != mark {
+			t.Fatalf("%v: unexpected mark %v", c.name, r.Mark)
+		}
+		if len(res) > 1 && res[1].Done {
+			t.Fatalf("%v: replies matched by the other trace\n%v", c.name, res[1].Marshal())
+		}
+	}
+}
+
+func TestFakeTraceSendFailed(t *testing.T) {
+	for _, window := range []int{0, 4} {
+		net := &fakeNet{hops: 3, iface: "vrf-blue", sendErr: fmt.Errorf("operation not supported")}
+		tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 2, NextHopWait: time.Millisecond * 20, TTLWindow: window}, net)
+		tc := fakeTrace(t)
+		tc.Interface = "vrf-blue"
+		res := tr.BatchTrace([]Trace{tc}, 1)[0]
+		if res.Err == nil || res.Done || len(res.Res) == 0 || res.AvgPktLoss != 1 {
+			t.Fatalf("window %v: unsent probes not lost %+v", window, res)
+		}
+	}
+}
+
+func TestFakeTraceIdExhausted(t *testing.T) {
+	net := &fakeNet{hops: 3}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 2, NextHopWait: time.Millisecond * 20}, net)
+	tc := fakeTrace(t)
+	flow := flowKey(protoNumICMP, tc.SrcAddr, tc.SrcPort, tc.DstAddr, tc.DstPort)
+	for i := 0; i < 0xffff; i++ {
+		if _, err := tr.ids.acquire(flow); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res := tr.BatchTrace([]Trace{tc}, 1)
+	if res[0].Err != errIdExhausted || res[0].Done || len(res[0].Res) != 0 {
+		t.Fatalf("trace without id not failed %+v", res[0])
+	}
+	tr.ids.release(flow, 42)
+	res = tr.BatchTrace([]Trace{tc}, 1)
+	if res[0].Err != nil || !res[0].Done {
+		t.Fatalf("trace with a released id failed %+v", res[0])
+	}
+}
+
+func TestFakeTraceForeignTCP(t *testing.T) {
+	net := &fakeNet{hops: 3}
+	tr := newFakeTracer(Config{TCP: true, MaxUnReply: 2, NextHopWait: time.Millisecond * 20}, net)
+	tc := fakeTrace(t)
+	// an ack of some other connection of the host.
+	tr.handleRcv(&ICMPRcv{RcvType: TCPReply, Proto: protoNumTCP, Src: tc.SrcAddr, SrcPort: 22, Dst: "10.0.0.7", DstPort: 51000})
+	res := tr.BatchTrace([]Trace{tc}, 1)
+	if !res[0].Done || res[0].Err != nil {
+		t.Fatalf("tcp trace failed\n%v", res[0].Marshal())
+	}
+	if st := tr.Stats(); st.Unmatched != 0 {
+		t.Fatalf("foreign segments counted unmatched %+v", st)
+	}
+}
+
+func TestFakeTraceListenerRefs(t *testing.T) {
+	// replies take long enough for the traces to run at once.
+	net := &fakeNet{hops: 3, delay: time.Millisecond * 5, netns: "/var/run/netns/blue"}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 2, NextHopWait: time.Millisecond * 20}, net)
+	tc := fakeTrace(t)
+	tc.Netns = "/var/run/netns/blue"
+	other := tc
+	other.DstAddr = "10.0.0.10"
+	res := tr.BatchTrace([]Trace{tc, other, tc}, 1)
+	for _, r := range res {
+		if !r.Done {
+			t.Fatalf("trace in netns failed\n%v", r.Marshal())
+		}
+	}
+	if net.receivers != 1 || net.senders != 1 {
+		t.Fatalf("traces of a netns opened %v receivers %v send sockets", net.receivers, net.senders)
+	}
+	if net.open != 0 || len(tr.listeners) != 0 {
+		t.Fatalf("netns still listened to after its traces, %v open %v", net.open, tr.listeners)
+	}
+}
+
+func TestFakeTraceLate(t *testing.T) {
+	net := &fakeNet{hops: 3, delay: time.Millisecond * 30}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 20}, net)
+	tc := fakeTrace(t)
+	tc.MaxTTL = 2
+	res := tr.BatchTrace([]Trace{tc}, 1)
+	r := res[0].Res
+	if len(r) != 2 || !r[0].Late || r[0].SrcTTL != "10.0.1.1" || r[0].Latency < net.delay {
+		t.Fatalf("late reply not attributed to its ttl\n%v", res[0].Marshal())
+	}
+}
+
+func TestBatchTraceContext(t *testing.T) {
+	net := &fakeNet{hops: 5, drop: func(ttl uint8) bool { return true }}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 30, NextHopWait: time.Second}, net)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	res := tr.BatchTraceContext(ctx, []Trace{fakeTrace(t)}, 1)
+	if time.Since(start) > time.Millisecond*500 {
+		t.Fatalf("trace not cancelled promptly")
+	}
+	if len(res) != 1 || !res[0].Cancelled || res[0].Done {
+		t.Fatalf("unexpected result %+v", res)
+	}
+}
+
+func TestBatchTraceStream(t *testing.T) {
+	net := &fakeNet{hops: 4}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 50}, net)
+	tc := fakeTrace(t)
+	tc.Retry = 2
+	count := map[string]int{}
+	var last TraceEvent
+	for ev := range tr.BatchTraceStream(context.Background(), []Trace{tc}, 1) {
+		count[ev.Type]++
+		last = ev
+	}
+	if count[EventProbeSent] != 8 || count[EventProbeReply] != 8 || count[EventHopDone] != 4 || count[EventTraceDone] != 1 {
+		t.Fatalf("unexpected events %v", count)
+	}
+	if last.Type != EventTraceDone || last.Result == nil || !last.Result.Done {
+		t.Fatalf("unexpected last event %+v", last)
+	}
+}
+
+func TestBatchTraceStreamAbandoned(t *testing.T) {
+	net := &fakeNet{hops: 30}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 50}, net)
+	var batch []Trace
+	for i := 0; i < 10; i++ {
+		tc := fakeTrace(t)
+		tc.SrcPort = uint16(i)
+		batch = append(batch, tc)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events := tr.BatchTraceStream(ctx, batch, 1)
+	<-events
+	// the reader goes away without draining once the channel is full.
+	time.Sleep(time.Millisecond * 50)
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for tr.Stats().Running != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("traces blocked on an abandoned reader %+v", tr.Stats())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	for range events {
+	}
+}
+
+func TestTraceParallel(t *testing.T) {
+	net := &fakeNet{hops: 5, delay: time.Millisecond * 5, drop: func(ttl uint8) bool { return ttl == 2 }}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 100, TTLWindow: 30}, net)
+	tc := fakeTrace(t)
+	tc.Retry = 2
+	start := time.Now()
+	res := tr.BatchTrace([]Trace{tc}, 1)
+	if time.Since(start) > time.Millisecond*300 {
+		t.Fatalf("ttl window not probed in parallel")
+	}
+	agg := res[0].Aggregate()
+	if !res[0].Done || len(agg.Res) != 5 || agg.Res[1].PacketLoss != 1 || !agg.Res[4].Reached {
+		t.Fatalf("unexpected result\n%v", res[0].Marshal())
+	}
+
+	net = &fakeNet{hops: 50, drop: func(ttl uint8) bool { return ttl >= 4 }}
+	tr = newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 50, TTLWindow: 4}, net)
+	res = tr.BatchTrace([]Trace{fakeTrace(t)}, 1)
+	if res[0].Done || len(res[0].Res) != 6 || res[0].Res[5].TTL != 6 {
+		t.Fatalf("unexpected result\n%v", res[0].Marshal())
+	}
+	// probes beyond the cut timed out too, they are not part of the loss.
+	if res[0].AvgPktLoss != 0.5 {
+		t.Fatalf("loss %v of hops\n%v", res[0].AvgPktLoss, res[0].Marshal())
+	}
+
+	// every reply is late, the hops still answer.
+	net = &fakeNet{hops: 8, delay: time.Millisecond * 30}
+	tr = newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 20, TTLWindow: 2}, net)
+	res = tr.BatchTrace([]Trace{fakeTrace(t)}, 1)
+	if !res[0].Done || len(res[0].Res) != 8 {
+		t.Fatalf("late hops counted silent\n%v", res[0].Marshal())
+	}
+}
+
+func TestBatchTracePool(t *testing.T) {
+	net := &fakeNet{hops: 3, delay: time.Millisecond * 2}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 50, MaxConcurrentTraces: 1}, net)
+	var batch []Trace
+	for i := 0; i < 4; i++ {
+		tc := fakeTrace(t)
+		tc.Priority = i % 2
+		tc.SrcPort = uint16(i)
+		batch = append(batch, tc)
+	}
+	var order []uint16
+	for ev := range tr.BatchTraceStream(context.Background(), batch, 1) {
+		if ev.Type == EventProbeSent {
+			st := tr.Stats()
+			if st.Running != 1 || st.QueueDepth+st.Running > len(batch) {
+				t.Fatalf("unexpected pool stats %+v", st)
+			}
+		}
+		if ev.Type == EventTraceDone {
+			order = append(order, ev.Result.SrcPort)
+		}
+	}
+	if fmt.Sprint(order) != "[1 3 0 2]" {
+		t.Fatalf("traces not admitted by priority %v", order)
+	}
+	if st := tr.Stats(); st.Running != 0 || st.QueueDepth != 0 {
+		t.Fatalf("unexpected pool stats %+v", st)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	res := tr.BatchTraceContext(ctx, batch, 1)
+	cancelled := 0
+	for _, r := range res {
+		if r.Cancelled {
+			cancelled++
+		}
+	}
+	if len(res) != len(batch) || cancelled == 0 {
+		t.Fatalf("queued traces not cancelled")
+	}
+	if st := tr.Stats(); st.Running != 0 || st.QueueDepth != 0 {
+		t.Fatalf("unexpected pool stats %+v", st)
+	}
+}
+
+func TestBatchTraceProtocols(t *testing.T) {
+	net := &fakeNet{hops: 3}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 3, NextHopWait: time.Millisecond * 50}, net)
+	icmp := fakeTrace(t)
+	udp := fakeTrace(t)
+	udp.Protocol = ProtoUDP
+	udp.Payload = []byte("probe")
+	udp.TOS = 0x10
+	udp.MaxUnReply = 1
+	udp.NextHopWait = time.Millisecond * 20
+	res := tr.BatchTrace([]Trace{icmp, udp}, 1)
+	if len(res) != 2 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	for _, r := range res {
+		if !r.Done || len(r.Res) != 3 {
+			t.Fatalf("unexpected %v trace\n%v", r.Protocol, r.Marshal())
+		}
+		if r.Protocol == ProtoUDP && (r.MaxUnReply != 1 || r.NextHopWait != time.Millisecond*20) {
+			t.Fatalf("trace options overridden %+v", r.Trace)
+		}
+	}
+}
+
+func TestCompareProtocols(t *testing.T) {
+	net := &fakeNet{hops: 5, filter: map[uint8]uint8{protoNumUDP: 3}}
+	tr := newFakeTracer(Config{ICMP: true, MaxUnReply: 2, NextHopWait: time.Millisecond * 20}, net)
+	cmp := tr.CompareProtocols(context.Background(), fakeTrace(t), 1)
+	if !cmp.Results[ProtoICMP].Done || !cmp.Results[ProtoTCP].Done || cmp.Results[ProtoUDP].Done {
+		t.Fatalf("unexpected comparison\n%v", cmp.Marshal())
+	}
+	if cmp.StopTTL[ProtoICMP] != 5 || cmp.StopTTL[ProtoTCP] != 5 || cmp.StopTTL[ProtoUDP] != 2 {
+		t.Fatalf("unexpected stop ttl %v\n%v", cmp.StopTTL, cmp.Marshal())
+	}
+	if len(cmp.Hops) != 5 || cmp.Hops[3].Hops[ProtoUDP].PacketLoss != 1 || cmp.Hops[4].Hops[ProtoTCP].SrcTTL != "10.0.0.9" {
+		t.Fatalf("unexpected hops\n%v", cmp.Marshal())
+	}
+	// a router on the way refusing tcp is not the target.
+	net = &fakeNet{hops: 5, prohibit: map[uint8]uint8{protoNumTCP: 3}}
+	tr = newFakeTracer(Config{ICMP: true, MaxUnReply: 2, NextHopWait: time.Millisecond * 20}, net)
+	tc := fakeTrace(t)
+	tc.MaxTTL = 8
+	cmp = tr.CompareProtocols(context.Background(), tc, 1)
+	if !cmp.Results[ProtoICMP].Done || cmp.Results[ProtoTCP].Done {
+		t.Fatalf("unexpected comparison\n%v", cmp.Marshal())
+	}
+	if hop := cmp.Hops[2].Hops[ProtoTCP]; hop.SrcTTL != "10.0.3.1" || hop.Reached {
+		t.Fatalf("filtering router reported reached\n%v", cmp.Marshal())
+	}
+}
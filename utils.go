@@ -1,13 +1,18 @@
 package go_mtr
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
-func checksum(buf []byte) uint16 {
+// sum16 is the one's complement sum of buf, before it is complemented into a checksum.
+func sum16(buf []byte) uint16 {
 	sum := uint32(0)
 	for ; len(buf) >= 2; buf = buf[2:] {
 		sum += uint32(buf[0])<<8 | uint32(buf[1])
@@ -18,7 +23,19 @@ func checksum(buf []byte) uint16 {
 	for sum > 0xffff {
 		sum = (sum >> 16) + (sum & 0xffff)
 	}
-	cSum := ^uint16(sum)
+	return uint16(sum)
+}
+
+func add16(a, b uint16) uint16 {
+	sum := uint32(a) + uint32(b)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+func checksum(buf []byte) uint16 {
+	cSum := ^sum16(buf)
 	/*
 	 * From RFC 768:
 	 * If the computed checksum is zero, it is transmitted as all ones (the
@@ -44,7 +61,47 @@ func IsIpv4(ip string) bool {
 	return false
 }
 
+// GetTrace checks t and fills its socket addresses, a DstAddr host name is
+// resolved within resolveTimeout.
 func GetTrace(t *Trace) (*Trace, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	return GetTraceContext(ctx, t)
+}
+
+func GetTraceContext(ctx context.Context, t *Trace) (*Trace, error) {
+	err := resolveTrace(ctx, t)
+	if err != nil {
+		return t, err
+	}
+	if t.Netns != "" {
+		t.Netns = netnsPath(t.Netns)
+		_, err = os.Stat(t.Netns)
+		if err != nil {
+			return t, fmt.Errorf("invalid netns (%v) error (%v)", t.Netns, err)
+		}
+	}
+	// interfaces and routes are those of the netns.
+	err = withNetns(t.Netns, func() error {
+		if t.Interface != "" {
+			_, err := net.InterfaceByName(t.Interface)
+			if err != nil {
+				return fmt.Errorf("invalid interface (%v) error (%v)", t.Interface, err)
+			}
+		}
+		if t.SrcAddr == "" && net.ParseIP(t.DstAddr) != nil {
+			src, err := sourceAddr(t.DstAddr, t.Interface, t.Mark)
+			if err != nil {
+				return err
+			}
+			t.SrcAddr = src
+			t.srcRouted = true
+		}
+		return nil
+	})
+	if err != nil {
+		return t, err
+	}
 	if t.Retry < 1 {
 		t.Retry = 1
 	}
@@ -56,24 +113,7 @@ func GetTrace(t *Trace) (*Trace, error) {
 	if dst == nil {
 		return t, fmt.Errorf("invalid dst addr (%v)", t.DstAddr)
 	}
-	if IsIpv4(t.SrcAddr) {
-		var addr [4]byte
-		copy(addr[:], src.To4())
-		sock := unix.SockaddrInet4{
-			Port: int(t.SrcPort),
-			Addr: addr,
-		}
-		t.SrcSockAddr = &sock
-	} else {
-		var addr [16]byte
-		copy(addr[:], src.To16())
-		sock := unix.SockaddrInet6{
-			Port:   int(t.SrcPort),
-			ZoneId: 0,
-			Addr:   addr,
-		}
-		t.SrcSockAddr = &sock
-	}
+	t.SrcSockAddr = srcSockAddr(src, t.SrcPort)
 	if IsIpv4(t.DstAddr) {
 		var addr [4]byte
 		copy(addr[:], dst.To4())
@@ -95,12 +135,101 @@ func GetTrace(t *Trace) (*Trace, error) {
 	return t, nil
 }
 
-// GetOutbondIP return default local ip which used to route packages outbond
+func srcSockAddr(src net.IP, port uint16) unix.Sockaddr {
+	if ip4 := src.To4(); ip4 != nil {
+		var addr [4]byte
+		copy(addr[:], ip4)
+		return &unix.SockaddrInet4{
+			Port: int(port),
+			Addr: addr,
+		}
+	}
+	var addr [16]byte
+	copy(addr[:], src.To16())
+	return &unix.SockaddrInet6{
+		Port:   int(port),
+		ZoneId: 0,
+		Addr:   addr,
+	}
+}
+
+// reroute picks SrcAddr again from the route of Mark, for traces marked after
+// GetTrace picked their source.
+func (t *Trace) reroute() error {
+	err := withNetns(t.Netns, func() error {
+		src, err := sourceAddr(t.DstAddr, t.Interface, t.Mark)
+		if err != nil {
+			return err
+		}
+		t.SrcAddr = src
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("route mark (%v) error (%v)", t.Mark, err)
+	}
+	t.SrcSockAddr = srcSockAddr(net.ParseIP(t.SrcAddr), t.SrcPort)
+	return nil
+}
+
+// netnsPath is the path of netns, given as a path or as the pid of a process
+// inside it.
+func netnsPath(netns string) string {
+	if _, err := strconv.Atoi(netns); err == nil {
+		return fmt.Sprintf("/proc/%v/ns/net", netns)
+	}
+	return netns
+}
+
+// GetOutbondIP return default local ip which used to route packages outbond,
+// empty when there is no default route.
 func GetOutbondIP() string {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+	src, err := SourceAddr("8.8.8.8")
+	if err != nil {
+		return ""
+	}
+	return src
+}
+
+// SourceAddr returns the address the routing table sends packets to dst from.
+func SourceAddr(dst string) (string, error) {
+	return sourceAddr(dst, "", 0)
+}
+
+func sourceAddr(dst string, iface string, mark uint32) (string, error) {
+	ip := net.ParseIP(dst)
+	if ip == nil {
+		return "", fmt.Errorf("invalid dst addr (%v)", dst)
+	}
+	src, err := routeSource(ip, iface, mark)
+	if err != nil {
+		return "", fmt.Errorf("no route to (%v) error (%v)", dst, err)
+	}
+	return src.String(), nil
+}
+
+// dialSource connects a udp socket to dst, which sends nothing, to learn the
+// source the kernel picks, out of iface and with mark unless unset.
+func dialSource(dst net.IP, iface string, mark uint32) (net.IP, error) {
+	dialer := net.Dialer{}
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		var err error
+		cErr := c.Control(func(fd uintptr) {
+			if iface != "" {
+				err = setSockOptBindToDevice(int(fd), iface)
+			}
+			if err == nil && mark != 0 {
+				err = setSockOptMark(int(fd), mark)
+			}
+		})
+		if cErr != nil {
+			return cErr
+		}
+		return err
+	}
+	conn, err := dialer.Dial("udp", net.JoinHostPort(dst.String(), "33434"))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	local := conn.LocalAddr().(*net.UDPAddr)
-	return local.IP.String()
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
 }